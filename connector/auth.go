@@ -0,0 +1,32 @@
+package connector
+
+import (
+	"github.com/JackKCWong/go-cranker-connector/internal/core"
+	"net/http"
+)
+
+// JWTAuth configures the verification of the bearer JWTs of the requests, see Connector.Auth.
+// Tokens are verified with the keys of a JWKS file or static keys, as per their alg and kid: HS256, RS256, PS256,
+// ES256 and their 384 and 512 variants, and EdDSA. exp is required, and so are iss and aud when configured.
+type JWTAuth = core.JWTAuth
+
+// AuthError fails the requests without a valid token with a 401, and the ones lacking Scopes with a 403.
+// Either is answered with a WWW-Authenticate challenge.
+type AuthError = core.AuthError
+
+// authenticate fails the requests which aren't authenticated with an *AuthError before they reach the next RoundTripper, their body is closed.
+func authenticate(a *core.Authenticator) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			err := a.Authenticate(req)
+			if err != nil {
+				if req.Body != nil {
+					_ = req.Body.Close()
+				}
+				return nil, err
+			}
+
+			return next.RoundTrip(req)
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package connector
+
+import (
+	"errors"
+	"fmt"
+	"github.com/JackKCWong/go-cranker-connector/internal/core"
+	"net/http"
+)
+
+// Canary sends a share of the requests to the ServiceURLs of a canary version, see Connector.Canary.
+// Its Weight can be changed while the Connector runs with SetCanaryWeight, or along with its ServiceURLs with Reconfigure.
+type Canary = core.Canary
+
+// VersionStatus counts the requests sent to the stable or the canary version.
+type VersionStatus = core.VersionStatus
+
+// canary sends the requests picked by s to the canary upstreams, the others to the next RoundTripper.
+func canary(s *core.CanarySplit) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return s.RoundTrip(req, next)
+		})
+	}
+}
+
+// newCanaryUpstreams returns the upstreams of the Canary of cfg, which share its configuration, or nil without one.
+func newCanaryUpstreams(cfg Config, client *http.Client) (*core.Upstreams, error) {
+	err := cfg.Canary.Validate()
+	if err != nil || cfg.Canary == nil {
+		return nil, err
+	}
+
+	cfg.ServiceURLs = cfg.Canary.ServiceURLs
+
+	return newUpstreams(cfg, client)
+}
+
+// SetCanaryWeight changes the Weight of the Canary right away, without replacing the sockets and upstreams
+// as Reconfigure does. The counts per version are kept.
+func (c *Connector) SetCanaryWeight(weight int) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.Canary == nil {
+		return errors.New("requires Canary")
+	}
+
+	if weight < 0 || weight > 100 {
+		return fmt.Errorf("invalid Canary: Weight %d not between 0 and 100", weight)
+	}
+
+	canary := *c.Canary
+	canary.Weight = weight
+	c.Canary = &canary
+	if c.split != nil {
+		c.split.SetWeight(weight)
+	}
+
+	return nil
+}
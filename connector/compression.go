@@ -0,0 +1,9 @@
+package connector
+
+import "github.com/JackKCWong/go-cranker-connector/internal/core"
+
+// Compression configures the gzip compression of the responses proxied from the service. It's negotiated
+// from the Accept-Encoding of each request, and applies to the ContentTypes of responses of MinSize or more.
+// A response already encoded, a partial one, or one with Cache-Control: no-transform is sent as is.
+// The body is compressed as it's streamed, each chunk read from the service is flushed to the router.
+type Compression = core.Compression
@@ -0,0 +1,161 @@
+package connector
+
+import (
+	"errors"
+	"fmt"
+	"github.com/JackKCWong/go-cranker-connector/internal/core"
+	"net/http"
+	"time"
+)
+
+// Config is the part of the Connector configuration which can be changed while it's running, see Reconfigure.
+type Config struct {
+	ServiceName         string
+	ServiceURL          string
+	ServiceURLs         []string
+	LoadBalancing       LoadBalancing
+	HealthCheck         HealthCheck
+	OutlierDetection    OutlierDetection
+	Retry               Retry
+	Canary              *Canary
+	SlidingWindow       int8
+	ShutdownTimeout     time.Duration
+	RediscoveryInterval time.Duration
+}
+
+// Config returns the current configuration, which is a starting point to Reconfigure.
+func (c *Connector) Config() Config {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.config()
+}
+
+// config must be called with c.m held.
+func (c *Connector) config() Config {
+	var canary *Canary
+	if c.Canary != nil {
+		copied := *c.Canary
+		canary = &copied
+	}
+
+	return Config{
+		ServiceName:         c.ServiceName,
+		ServiceURL:          c.ServiceURL,
+		ServiceURLs:         append([]string(nil), c.ServiceURLs...),
+		LoadBalancing:       c.LoadBalancing,
+		HealthCheck:         c.HealthCheck,
+		OutlierDetection:    c.OutlierDetection,
+		Retry:               c.Retry,
+		Canary:              canary,
+		SlidingWindow:       c.slidingWindow,
+		ShutdownTimeout:     c.ShutdownTimeout,
+		RediscoveryInterval: c.RediscoveryInterval,
+	}
+}
+
+// Reconfigure changes the configuration without a restart.
+// Sockets connected after the change use the new ServiceName, ServiceURL(s) and SlidingWindow,
+// idle sockets with the old ones are closed once they are replaced, and in-flight requests finish with the old ones.
+// The upstreams start over with a clean status, health checks included, while the counts per version of a Canary are kept.
+// ShutdownTimeout applies from the next shutdown, RediscoveryInterval from the next discovery, which happens right away.
+// A Connector which isn't running simply keeps cfg for the next Connect, except SlidingWindow which is given to Connect.
+func (c *Connector) Reconfigure(cfg Config) error {
+	c.m.Lock()
+	inProcess := c.Handler != nil || c.accept != nil
+	client := c.ServiceHttpClient
+	c.m.Unlock()
+
+	var upstreams, canaryUpstreams *core.Upstreams
+	if !inProcess {
+		var err error
+		upstreams, err = newUpstreams(cfg, client)
+		if err != nil {
+			return err
+		}
+
+		canaryUpstreams, err = newCanaryUpstreams(cfg, client)
+		if err != nil {
+			return err
+		}
+	} else if cfg.Canary != nil {
+		return errors.New("Canary requires ServiceURL")
+	}
+
+	if cfg.ServiceName == "" {
+		return errors.New("requires ServiceName")
+	}
+
+	if cfg.SlidingWindow <= 0 {
+		return errors.New("slidingWindow must be greater than 0")
+	}
+
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = 5 * time.Second
+	}
+
+	c.m.Lock()
+	c.ServiceName = cfg.ServiceName
+	c.ServiceURL = cfg.ServiceURL
+	c.ServiceURLs = cfg.ServiceURLs
+	c.LoadBalancing = cfg.LoadBalancing
+	c.HealthCheck = cfg.HealthCheck
+	c.OutlierDetection = cfg.OutlierDetection
+	c.Retry = cfg.Retry
+	c.Canary = cfg.Canary
+	c.slidingWindow = cfg.SlidingWindow
+	c.ShutdownTimeout = cfg.ShutdownTimeout
+	c.RediscoveryInterval = cfg.RediscoveryInterval
+	if c.state != stateRunning {
+		c.m.Unlock()
+		return nil
+	}
+	c.upstreams = upstreams
+	c.split.Update(cfg.Canary, canaryUpstreams)
+	c.startHealthChecks()
+	crankers, logger := c.crankers, c.log
+	c.triggerDiscovery()
+	c.m.Unlock()
+
+	logger.Info().
+		Str("newServiceURL", cfg.ServiceURL).
+		Strs("newServiceURLs", cfg.ServiceURLs).
+		Str("newServiceName", cfg.ServiceName).
+		Msg("reconfiguring connector")
+
+	return forEachCranker(crankers, func(wss *core.WSSConnector) error {
+		wss.Reconfigure(core.Settings{
+			ServiceName:   cfg.ServiceName,
+			ServiceURL:    cfg.ServiceURL,
+			SlidingWindow: cfg.SlidingWindow,
+			Upstreams:     upstreams,
+		})
+		return nil
+	})
+}
+
+// newUpstreams returns the upstreams of cfg, ServiceURLs if any or else ServiceURL.
+func newUpstreams(cfg Config, client *http.Client) (*core.Upstreams, error) {
+	serviceURLs := cfg.ServiceURLs
+	if len(serviceURLs) == 0 && cfg.ServiceURL != "" {
+		serviceURLs = []string{cfg.ServiceURL}
+	}
+
+	switch cfg.LoadBalancing {
+	case "", RoundRobin, LeastInFlight, Random:
+	default:
+		return nil, fmt.Errorf("unknown LoadBalancing %q", cfg.LoadBalancing)
+	}
+
+	upstreams, err := core.NewUpstreams(serviceURLs, client)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreams.LoadBalancing = cfg.LoadBalancing
+	upstreams.HealthCheck = cfg.HealthCheck
+	upstreams.OutlierDetection = cfg.OutlierDetection
+	upstreams.Retry = cfg.Retry
+
+	return upstreams, nil
+}
@@ -4,8 +4,11 @@ import (
 	"context"
 	"errors"
 	"github.com/JackKCWong/go-cranker-connector/internal/core"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+	"net"
 	"net/http"
 	"sync"
 	"time"
@@ -13,15 +16,100 @@ import (
 
 type Discoverer func() []string
 
+// ErrAlreadyConnected is returned by Connect when the Connector is running or draining.
+var ErrAlreadyConnected = errors.New("connector is already connected")
+
+// state of a Connector: new -> running -> draining -> stopped. A stopped Connector can be connected again.
+type state int32
+
+const (
+	stateNew state = iota
+	stateRunning
+	stateDraining
+	stateStopped
+)
+
 // Connector connects to a set of crankers
 type Connector struct {
 	// ServiceName is registered to cranker to prefix the url under cranker. e.g. hello-world is accessible via /hello-world
 	ServiceName string
-	// ServiceURL is the root URL where the service is running
+	// ServiceURL is the root URL where the service is running, requests are sent to paths under it.
+	// A service listening on a unix socket is given as unix:///path/to.sock, or unix:///path/to.sock:/base/path
+	// with a base path. The transport of ServiceHttpClient is then copied to dial the socket.
+	// A service speaking HTTP/2 without TLS, e.g. a gRPC service, is given as h2c://host:port, its requests and
+	// responses are then streamed at the same time. Trailers are forwarded when the router picks the cranker-trailers subprotocol.
 	ServiceURL string
+	// ServiceURLs are several replicas of the service, used instead of ServiceURL when not empty.
+	// Requests are spread between them as per LoadBalancing, and kept away from the unhealthy ones
+	// as per HealthCheck and OutlierDetection. See Status for the status of each of them.
+	ServiceURLs []string
+	// LoadBalancing is how one of ServiceURLs is picked for a request, RoundRobin by default.
+	LoadBalancing LoadBalancing
+	// HealthCheck configures the active health checks of ServiceURLs, there are none by default.
+	HealthCheck HealthCheck
+	// OutlierDetection configures the ejection of ServiceURLs failing requests, there is none by default.
+	OutlierDetection OutlierDetection
+	// Retry configures the retries of the requests failing to reach the service while it restarts,
+	// with the connection refused or reset, there are none by default.
+	Retry Retry
+	// Canary sends Weight percent of the requests to the ServiceURLs of a canary version instead, optionally keeping
+	// each client on one version. The Weight can be changed with Reconfigure, and Status counts the requests per version.
+	Canary *Canary
+	// Forwarding configures the Forwarded and X-Forwarded-* headers of the requests given to the service,
+	// so that it can build absolute URLs. By default, the headers sent by the router are preserved.
+	Forwarding Forwarding
+	// RewritePaths adds the /ServiceName stripped from the requests back to the paths the responses point to:
+	// Location, Content-Location and Refresh headers with an absolute path or a url to the same host, and cookie paths.
+	// It's for a service unaware of its prefix, a path under the prefix already is left as is.
+	RewritePaths bool
+	// Compression gzips the responses proxied from the service for the clients accepting it, when not nil.
+	// Responses already encoded are sent as is, and the others are compressed as they are streamed.
+	Compression *Compression
+	// MaxRequestBodySize is the maximum size of a request body, zero meaning no limit. A Rule can set another one.
+	// A request with a larger Content-Length is answered with a 413 without reaching the service,
+	// a streamed body crossing it fails with ErrBodyTooLarge, which is answered with a 413 too.
+	MaxRequestBodySize int64
+	// MaxRequestHeaderBytes is the maximum size of the request line and headers, 1 MB by default.
+	// MaxRequestHeaders is the maximum number of header values, zero meaning no limit.
+	// A request over either is answered with a 431 without reaching the service.
+	MaxRequestHeaderBytes int
+	MaxRequestHeaders     int
+	// MaxWebSocketMessageSize is the maximum size of a websocket message from the router: a request head,
+	// or a chunk of a request body. Only whole messages are limited, not the websocket frames they are split in.
+	// It's MaxRequestHeaderBytes and 4 KB to spare by default, i.e. 1 MB and 4 KB, or 32 KB if that's less.
+	// A larger message is a protocol error, the socket is closed with 1009 and the request fails without a response.
+	MaxWebSocketMessageSize int64
+	// Auth rejects the requests without a valid bearer JWT with a 401, or a 403 without the required scopes,
+	// before they reach the service. The verified claims can be passed to the service as headers.
+	Auth *JWTAuth
+	// RateLimit limits the rate of the requests proxied to the service, per client IP by default, unless a Rule has one.
+	// The requests over it are answered with a 429 and a Retry-After without reaching the service.
+	RateLimit *RateLimit
+	// Mirror copies a share of the requests to a shadow service, e.g. a new version of the service, once the service
+	// responded. The shadow responses are discarded, their status is compared to the one of the service, see Status.
+	// The shadow requests are copied before Rules apply, so a rewritten path or header isn't mirrored.
+	// Drain and Shutdown wait for the shadow requests in-flight like for the others, Shutdown cancels them at its timeout.
+	Mirror *Mirror
+	// ErrorPages customizes the responses to the requests which can't be proxied, see ProxyError.
+	ErrorPages ErrorPages
+	// Middleware wraps the requests proxied to ServiceURL(s), the first one being the outermost, see Middleware.
+	// They are followed by Auth, RateLimit, Mirror, Rules and Canary. An in-process Handler is wrapped with http middleware instead.
+	Middleware []Middleware
+	// Rules rewrite the requests proxied to ServiceURL(s), or send them to other ServiceURLs, see Rule and LoadRules.
+	// Only the first matching rule applies. Rules are applied after Middleware.
+	Rules []Rule
+	// ReadinessProbe, when not nil, keeps the Connector registered only while the service is ready.
+	ReadinessProbe *ReadinessProbe
+	// Handler serves the requests in-process when the service runs in the same process, instead of proxying
+	// them to ServiceURL with ServiceHttpClient. Either ServiceURL or Handler is required.
+	// The ResponseWriter streams straight to cranker: it supports http.Flusher but not http.Hijacker.
+	// Trailers are sent as headers if nothing is written, and after the body when the router picks the cranker-trailers
+	// subprotocol. They are dropped otherwise.
+	Handler http.Handler
 	// WSSHttpClient is the cranker facing http client used for websocket connection
 	WSSHttpClient *http.Client
-	// ServiceHttpClient is the service facing http client used for servicing request/response
+	// ServiceHttpClient is the service facing http client used for servicing request/response.
+	// The default one passes redirects on to the client instead of following them.
 	ServiceHttpClient *http.Client
 	// ShutdownTimeout is the grace period for shutdown. Any long running request/response isn't finish before timeout are cancelled.
 	ShutdownTimeout time.Duration
@@ -29,16 +117,55 @@ type Connector struct {
 	// The Connector does a diff of the Discoverer result and current connections to decide if keep/add/remove.
 	// A zero value means never rediscover beyond the first time.
 	RediscoveryInterval time.Duration
-	m                   sync.Mutex
-	crankers            *sync.Map
-	log                 zerolog.Logger
+	// MaxSocketIdleAge is how long an idle socket is offered to the router before it's replaced by a fresh one,
+	// e.g. to stay below the idle timeout of a load balancer in between. A zero value means forever.
+	MaxSocketIdleAge time.Duration
+	// MaxSocketLifetime is how long a socket lives at most after it's connected, a zero value means forever.
+	// Expired idle sockets are closed only after their replacements are connected, so the router never runs short.
+	// A request still in-flight on a socket when it expires, e.g. a long stream, is cancelled.
+	MaxSocketLifetime time.Duration
+	m                 sync.Mutex
+	accept            func(ctx context.Context, conn net.Conn) error
+	upstreams         *core.Upstreams
+	rules             rules
+	rateLimiter       *core.RateLimiter
+	mirrorer          *core.Mirrorer
+	split             *core.CanarySplit
+	middleware        []Middleware
+	forwarder         *core.Forwarder
+	stopChecks        context.CancelFunc
+	state             state
+	crankers          *sync.Map
+	instanceID        string
+	slidingWindow     int8
+	rediscover        chan struct{}
+	ready             bool
+	sigDrain          context.Context
+	drain             context.CancelFunc
+	wg                *sync.WaitGroup
+	done              chan struct{}
+	err               error
+	log               zerolog.Logger
 }
 
+// Connect connects to the crankers returned by crankerDiscoverer in the background and returns right away.
+// Use Done to wait for the Connector to stop, or Run to connect and block.
+// A Connector can be connected again after it's stopped, e.g. to disconnect from the crankers during maintenance.
 func (c *Connector) Connect(crankerDiscoverer Discoverer, slidingWindow int8) error {
+	return c.start(crankerDiscoverer, slidingWindow, nil)
+}
+
+// start connects as per Connect, with accept serving the requests as connections when not nil, see Listen.
+func (c *Connector) start(crankerDiscoverer Discoverer, slidingWindow int8, accept func(ctx context.Context, conn net.Conn) error) error {
 	c.m.Lock()
-	c.crankers = &sync.Map{}
+	defer c.m.Unlock()
+
+	if c.state == stateRunning || c.state == stateDraining {
+		return ErrAlreadyConnected
+	}
 
-	if c.ServiceURL == "" {
+	inProcess := c.Handler != nil || accept != nil
+	if c.ServiceURL == "" && len(c.ServiceURLs) == 0 && !inProcess {
 		return errors.New("requires ServiceURL")
 	}
 
@@ -46,114 +173,500 @@ func (c *Connector) Connect(crankerDiscoverer Discoverer, slidingWindow int8) er
 		return errors.New("requires ServiceName")
 	}
 
+	if len(c.Middleware) > 0 && inProcess {
+		return errors.New("Middleware requires ServiceURL, wrap the Handler instead")
+	}
+
+	if len(c.Rules) > 0 && inProcess {
+		return errors.New("Rules require ServiceURL")
+	}
+
+	if c.RateLimit != nil && inProcess {
+		return errors.New("RateLimit requires ServiceURL")
+	}
+
+	if c.Auth != nil && inProcess {
+		return errors.New("Auth requires ServiceURL")
+	}
+
+	if c.Mirror != nil && inProcess {
+		return errors.New("Mirror requires ServiceURL")
+	}
+
+	if c.Canary != nil && inProcess {
+		return errors.New("Canary requires ServiceURL")
+	}
+
+	if slidingWindow <= 0 {
+		return errors.New("slidingWindow must be greater than 0")
+	}
+
 	if c.WSSHttpClient == nil {
 		c.WSSHttpClient = http.DefaultClient
 	}
 
 	if c.ServiceHttpClient == nil {
-		c.ServiceHttpClient = http.DefaultClient
+		c.ServiceHttpClient = &http.Client{
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+
+	if p := c.ReadinessProbe; p != nil && p.Check == nil && (p.Path == "" || accept != nil) {
+		return errors.New("ReadinessProbe requires Check, or Path with a ServiceURL or Handler")
+	}
+
+	forwarder, err := core.NewForwarder(c.Forwarding)
+	if err != nil {
+		return err
+	}
+
+	err = c.Compression.Validate()
+	if err != nil {
+		return err
+	}
+
+	var upstreams, canaryUpstreams *core.Upstreams
+	if !inProcess {
+		upstreams, err = newUpstreams(c.config(), c.ServiceHttpClient)
+		if err != nil {
+			return err
+		}
+
+		canaryUpstreams, err = newCanaryUpstreams(c.config(), c.ServiceHttpClient)
+		if err != nil {
+			return err
+		}
+	}
+
+	rules, err := compileRules(c.Rules, c.config(), c.ServiceHttpClient)
+	if err != nil {
+		return err
+	}
+
+	var rateLimiter *core.RateLimiter
+	if c.RateLimit != nil {
+		limit := *c.RateLimit
+		if limit.Name == "" {
+			limit.Name = c.ServiceName
+		}
+
+		rateLimiter, err = core.NewRateLimiter(limit)
+		if err != nil {
+			return err
+		}
+	}
+
+	var authenticator *core.Authenticator
+	if c.Auth != nil {
+		authenticator, err = core.NewAuthenticator(*c.Auth)
+		if err != nil {
+			return err
+		}
+	}
+
+	var mirrorer *core.Mirrorer
+	if c.Mirror != nil {
+		mirrorer, err = core.NewMirrorer(*c.Mirror, c.ServiceHttpClient, log.With().Str("serviceName", c.ServiceName).Logger())
+		if err != nil {
+			return err
+		}
+	}
+
+	middleware := c.Middleware
+	if authenticator != nil {
+		middleware = append(append([]Middleware(nil), middleware...), authenticate(authenticator))
+	}
+	if rateLimiter != nil || rules.rateLimited() {
+		middleware = append(append([]Middleware(nil), middleware...), rateLimits(rules, rateLimiter, forwarder))
+	}
+	if mirrorer != nil {
+		middleware = append(append([]Middleware(nil), middleware...), mirror(mirrorer))
+	}
+	if len(rules) > 0 {
+		middleware = append(append([]Middleware(nil), middleware...), rules.middleware())
+	}
+	if c.split == nil {
+		c.split = core.NewCanarySplit()
+	}
+	if !inProcess {
+		middleware = append(append([]Middleware(nil), middleware...), canary(c.split))
 	}
 
 	if c.ShutdownTimeout == 0 {
 		c.ShutdownTimeout = 5 * time.Second
 	}
 
-	if slidingWindow <= 0 {
-		return errors.New("slidingWindow must be greater than 0")
+	if c.MaxRequestHeaderBytes == 0 {
+		c.MaxRequestHeaderBytes = http.DefaultMaxHeaderBytes
+	}
+
+	if c.MaxWebSocketMessageSize == 0 {
+		c.MaxWebSocketMessageSize = int64(c.MaxRequestHeaderBytes) + 4096
+		if c.MaxWebSocketMessageSize < 32768 {
+			c.MaxWebSocketMessageSize = 32768
+		}
+	}
+
+	if c.MaxWebSocketMessageSize < int64(c.MaxRequestHeaderBytes)+2 {
+		return errors.New("MaxWebSocketMessageSize must be larger than MaxRequestHeaderBytes")
 	}
 
+	c.instanceID = uuid.NewString()
 	c.log = log.With().
 		Str("serviceURL", c.ServiceURL).
 		Str("serviceName", c.ServiceName).
+		Str("connectorInstanceID", c.instanceID).
 		Logger()
 
-	c.m.Unlock()
+	c.slidingWindow = slidingWindow
+	c.rediscover = make(chan struct{}, 1)
+	c.ready = c.ReadinessProbe == nil
+	c.crankers = &sync.Map{}
+	c.sigDrain, c.drain = context.WithCancel(context.Background())
+	c.wg = &sync.WaitGroup{}
+	if c.done == nil || c.state == stateStopped {
+		c.done = make(chan struct{})
+	}
+	c.err = nil
+	c.state = stateRunning
+	c.accept = accept
+	c.upstreams = upstreams
+	c.rules = rules
+	c.rateLimiter = rateLimiter
+	c.mirrorer = mirrorer
+	c.split.Update(c.Canary, canaryUpstreams)
+	c.middleware = middleware
+	c.forwarder = forwarder
+	c.startHealthChecks()
+
 	crankerDiscoverChan := make(chan string, 10)
-	go func() {
-		// discovery
-		for {
-			urls := crankerDiscoverer()
-			var latest map[string]bool = make(map[string]bool)
-			for _, url := range urls {
-				latest[url] = true
-				_, exist := c.crankers.Load(url)
-				if !exist {
-					crankerDiscoverChan <- url
-				}
-			}
+	c.wg.Add(2)
+	go c.discover(c.sigDrain, c.wg, crankerDiscoverer, crankerDiscoverChan)
+	go c.connect(c.sigDrain, c.wg, crankerDiscoverChan)
+	if c.ReadinessProbe != nil {
+		c.wg.Add(1)
+		go c.watchReadiness(c.sigDrain, c.wg, *c.ReadinessProbe)
+	}
 
-			c.crankers.Range(func(existing, wss interface{}) bool {
-				if !latest[existing.(string)] {
-					c.crankers.Delete(existing)
-					go wss.(*core.WSSConnector).Shutdown()
-				}
+	c.log.Info().
+		Msg("connector started")
 
-				return true
-			})
-			if c.RediscoveryInterval == 0 {
-				close(crankerDiscoverChan)
-				return
-			} else {
-				<-time.After(c.RediscoveryInterval)
-				continue
+	return nil
+}
+
+// startHealthChecks stops the health checks of the previous upstreams, and starts those of the current ones,
+// including the upstreams of the Rules. It must be called with c.m held.
+func (c *Connector) startHealthChecks() {
+	if c.stopChecks != nil {
+		c.stopChecks()
+	}
+
+	all := c.rules.upstreams()
+	if c.upstreams != nil {
+		all = append(all, c.upstreams)
+	}
+	if canaryUpstreams := c.split.Upstreams(); canaryUpstreams != nil {
+		all = append(all, canaryUpstreams)
+	}
+
+	var ctx context.Context
+	ctx, c.stopChecks = context.WithCancel(c.sigDrain)
+	for _, upstreams := range all {
+		c.wg.Add(1)
+		go func(wg *sync.WaitGroup, upstreams *core.Upstreams) {
+			defer wg.Done()
+			upstreams.RunHealthChecks(ctx)
+		}(c.wg, upstreams)
+	}
+}
+
+// bodyLimit returns the MaxRequestBodySize of a request, the one of the matching rule if any.
+// It must be called with c.m held.
+func (c *Connector) bodyLimit() func(req *http.Request) int64 {
+	max, rules := c.MaxRequestBodySize, c.rules
+
+	return func(req *http.Request) int64 {
+		if r := rules.match(req); r != nil && r.MaxRequestBodySize != 0 {
+			return r.MaxRequestBodySize
+		}
+
+		return max
+	}
+}
+
+// Run connects to the crankers and blocks until ctx is done, then shuts down within ShutdownTimeout.
+// It also returns when the Connector is shutdown by other means. The returned error is the same as Err().
+func (c *Connector) Run(ctx context.Context, crankerDiscoverer Discoverer, slidingWindow int8) error {
+	err := c.Connect(crankerDiscoverer, slidingWindow)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		c.Shutdown()
+	case <-c.Done():
+	}
+
+	return c.Err()
+}
+
+func (c *Connector) discover(sigDrain context.Context, wg *sync.WaitGroup, crankerDiscoverer Discoverer, crankerDiscoverChan chan<- string) {
+	defer wg.Done()
+	defer close(crankerDiscoverChan)
+
+	for {
+		urls := crankerDiscoverer()
+		var latest map[string]bool = make(map[string]bool)
+		for _, url := range urls {
+			latest[url] = true
+			_, exist := c.crankers.Load(url)
+			if !exist {
+				crankerDiscoverChan <- url
 			}
 		}
-	}()
 
-	go func() {
-		// connect and serve
-		for url := range crankerDiscoverChan {
-			wss := &core.WSSConnector{
-				RegisterURL:       url,
-				SlidingWindow:     slidingWindow,
-				ServiceName:       c.ServiceName,
-				ServiceURL:        c.ServiceURL,
-				ShutdownTimeout:   c.ShutdownTimeout,
-				WSSHttpClient:     c.WSSHttpClient,
-				ServiceHttpClient: c.ServiceHttpClient,
+		c.crankers.Range(func(existing, wss interface{}) bool {
+			if !latest[existing.(string)] {
+				c.crankers.Delete(existing)
+				c.retire(wg, wss.(*core.WSSConnector))
 			}
 
-			c.crankers.Store(wss.RegisterURL, wss)
-
-			go func() {
-				err := wss.ConnectAndServe()
-				if err != nil {
-					switch err {
-					case context.Canceled:
-						c.log.Info().
-							Str("crankerWSS", wss.RegisterURL).
-							Msg("wss connector exiting gracefully")
-					case context.DeadlineExceeded:
-						c.log.Info().
-							Str("crankerWSS", wss.RegisterURL).
-							Msg("wss connector exiting forcefully")
-					}
-
-					return
-				}
-			}()
+			return true
+		})
+
+		// with a zero interval, only a Reconfigure triggers the next discovery.
+		var rediscover <-chan time.Time
+		if interval := c.Config().RediscoveryInterval; interval > 0 {
+			rediscover = time.After(interval)
 		}
-	}()
 
-	c.log.Info().
-		Msg("connector started")
+		select {
+		case <-sigDrain.Done():
+			return
+		case <-c.rediscover:
+			continue
+		case <-rediscover:
+			continue
+		}
+	}
+}
 
-	return nil
+// retire deregisters from a cranker and shuts the connection down, in the background.
+func (c *Connector) retire(wg *sync.WaitGroup, wss *core.WSSConnector) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), c.Config().ShutdownTimeout)
+		defer cancel()
+		_ = wss.Shutdown(ctx)
+	}()
 }
 
-func (c *Connector) Shutdown() {
-	c.m.Lock()
-	defer c.m.Unlock()
+// triggerDiscovery runs the Discoverer right away. It must be called with c.m held, while running.
+func (c *Connector) triggerDiscovery() {
+	select {
+	case c.rediscover <- struct{}{}:
+	default:
+		// a rediscovery is pending already
+	}
+}
+
+func (c *Connector) connect(sigDrain context.Context, wg *sync.WaitGroup, crankerDiscoverChan <-chan string) {
+	defer wg.Done()
+
+	for url := range crankerDiscoverChan {
+		c.m.Lock()
+		if sigDrain.Err() != nil || !c.ready {
+			// draining or the service isn't ready, don't offer any new sockets
+			c.m.Unlock()
+			continue
+		}
+
+		if _, exist := c.crankers.Load(url); exist {
+			// discovered again before this one is connected
+			c.m.Unlock()
+			continue
+		}
 
-	wg := &sync.WaitGroup{}
-	c.crankers.Range(func(_, wss interface{}) bool {
+		wss := &core.WSSConnector{
+			RegisterURL:         url,
+			ConnectorInstanceID: c.instanceID,
+			SlidingWindow:       c.slidingWindow,
+			ServiceName:         c.ServiceName,
+			ServiceURL:          c.ServiceURL,
+			Upstreams:           c.upstreams,
+			Handler:             c.Handler,
+			Accept:              c.accept,
+			Forwarder:           c.forwarder,
+			RewritePaths:        c.RewritePaths,
+			Compression:         c.Compression,
+			ErrorPages:          c.ErrorPages,
+			BodyLimit:           c.bodyLimit(),
+			MaxHeaderBytes:      c.MaxRequestHeaderBytes,
+			MaxHeaders:          c.MaxRequestHeaders,
+			MaxMessageSize:      c.MaxWebSocketMessageSize,
+			Middleware:          c.middleware,
+			MaxSocketIdleAge:    c.MaxSocketIdleAge,
+			MaxSocketLifetime:   c.MaxSocketLifetime,
+			WSSHttpClient:       c.WSSHttpClient,
+			ServiceHttpClient:   c.ServiceHttpClient,
+		}
+		c.crankers.Store(wss.RegisterURL, wss)
 		wg.Add(1)
+		c.m.Unlock()
+
 		go func() {
 			defer wg.Done()
-			wss.(*core.WSSConnector).Shutdown()
+			err := wss.ConnectAndServe()
+			if err != nil {
+				switch err {
+				case context.Canceled:
+					c.log.Info().
+						Str("crankerWSS", wss.RegisterURL).
+						Msg("wss connector exiting gracefully")
+				case context.DeadlineExceeded:
+					c.log.Info().
+						Str("crankerWSS", wss.RegisterURL).
+						Msg("wss connector exiting forcefully")
+				}
+
+				return
+			}
 		}()
-		return true
+	}
+}
+
+// Drain deregisters from all crankers so that no new request is routed here, then waits for in-flight requests to finish.
+// In-flight requests still running when ctx is done are not cancelled; call Shutdown to cancel them.
+// Drain is meant for rolling deploys, where the new instance is already registered before the old one drains.
+func (c *Connector) Drain(ctx context.Context) error {
+	c.m.Lock()
+	if c.state != stateRunning && c.state != stateDraining {
+		c.m.Unlock()
+		return nil
+	}
+	c.state = stateDraining
+	c.drain()
+	crankers, mirrorer := c.crankers, c.mirrorer
+	c.m.Unlock()
+
+	c.log.Info().Msg("draining connector")
+
+	err := forEachCranker(crankers, func(wss *core.WSSConnector) error {
+		return wss.Drain(ctx)
 	})
+	if err == nil && mirrorer != nil {
+		// no request is in-flight anymore to mirror another one.
+		err = mirrorer.Wait(ctx)
+	}
 
+	return err
+}
+
+// Shutdown drains the connector for at most ShutdownTimeout, then cancels any request still in-flight.
+func (c *Connector) Shutdown() {
+	c.m.Lock()
+	timeout := c.ShutdownTimeout
+	c.m.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_ = c.ShutdownContext(ctx)
+}
+
+// ShutdownContext drains the connector until ctx is done, then cancels any request still in-flight.
+// It returns once every goroutine of the Connector has exited, with ctx.Err() if any request had to be cancelled.
+// Shutting down a Connector which never connected simply stops it.
+func (c *Connector) ShutdownContext(ctx context.Context) error {
+	c.m.Lock()
+	switch c.state {
+	case stateNew:
+		c.stop(c.doneChan(), nil)
+		c.m.Unlock()
+		return nil
+	case stateStopped:
+		err := c.err
+		c.m.Unlock()
+		return err
+	}
+
+	c.state = stateDraining
+	c.drain()
+	crankers, wg, done, mirrorer := c.crankers, c.wg, c.done, c.mirrorer
+	c.m.Unlock()
+
+	err := forEachCranker(crankers, func(wss *core.WSSConnector) error {
+		return wss.Shutdown(ctx)
+	})
 	wg.Wait()
+
+	if mirrorer != nil {
+		if waitErr := mirrorer.Wait(ctx); err == nil {
+			err = waitErr
+		}
+		mirrorer.Close()
+	}
+
+	c.m.Lock()
+	c.stop(done, err)
+	c.m.Unlock()
+
+	c.log.Info().Msg("connector is down")
+
+	return err
+}
+
+// stop must be called with c.m held. done identifies the run being stopped,
+// so that a concurrent shutdown of a previous run can't stop a Connector which is connected again.
+func (c *Connector) stop(done chan struct{}, err error) {
+	if c.state == stateStopped || c.done != done {
+		return
+	}
+
+	c.state = stateStopped
+	c.err = err
+	close(c.done)
+}
+
+// doneChan must be called with c.m held.
+func (c *Connector) doneChan() chan struct{} {
+	if c.done == nil {
+		c.done = make(chan struct{})
+	}
+
+	return c.done
+}
+
+// Done returns a channel that's closed when the Connector is stopped.
+// After the Connector is connected again, Done returns a new channel for the new run.
+func (c *Connector) Done() <-chan struct{} {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.doneChan()
+}
+
+// Err returns nil until Done is closed. After that, it returns nil if all in-flight requests finished gracefully,
+// or the context error which caused them to be cancelled.
+func (c *Connector) Err() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.err
+}
+
+func forEachCranker(crankers *sync.Map, fn func(wss *core.WSSConnector) error) error {
+	g := &errgroup.Group{}
+	crankers.Range(func(_, wss interface{}) bool {
+		g.Go(func() error {
+			return fn(wss.(*core.WSSConnector))
+		})
+		return true
+	})
+
+	return g.Wait()
 }
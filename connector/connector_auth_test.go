@@ -0,0 +1,248 @@
+package connector
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+// sign returns a JWT of claims signed with key as per alg.
+func sign(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	head, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(head) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+		signature = append(pad(r, 32), pad(s, 32)...)
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		_, _ = mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case nil:
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + b64.EncodeToString(signature)
+}
+
+// pad returns the bytes of n left-padded to size.
+func pad(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// writeJWKS writes the public keys of keys by kid to a JWKS file.
+func writeJWKS(t *testing.T, path string, keys map[string]interface{}) {
+	var jwks []map[string]string
+	for kid, key := range keys {
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			jwks = append(jwks, map[string]string{
+				"kty": "RSA", "kid": kid, "use": "sig",
+				"n": b64.EncodeToString(key.N.Bytes()),
+				"e": b64.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		case *ecdsa.PrivateKey:
+			jwks = append(jwks, map[string]string{
+				"kty": "EC", "kid": kid, "crv": "P-256",
+				"x": b64.EncodeToString(pad(key.X, 32)),
+				"y": b64.EncodeToString(pad(key.Y, 32)),
+			})
+		}
+	}
+
+	content, _ := json.Marshal(map[string]interface{}{"keys": jwks})
+	err := ioutil.WriteFile(path, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newClaimsService answers the X-User and X-Roles headers of the requests, which it counts in calls.
+func newClaimsService(t *testing.T, calls *int32) string {
+	service := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(calls, 1)
+		_, _ = rw.Write([]byte(req.Header.Get("X-User") + " " + req.Header.Get("X-Roles")))
+	}))
+	t.Cleanup(service.Close)
+
+	return service.URL
+}
+
+func claims(overrides ...interface{}) map[string]interface{} {
+	c := map[string]interface{}{
+		"iss":   "https://issuer.test",
+		"aud":   []string{"other", "orders"},
+		"sub":   "alice",
+		"roles": []string{"admin", "ops"},
+		"scope": "orders:read orders:write",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+	}
+	for i := 0; i < len(overrides); i += 2 {
+		c[overrides[i].(string)] = overrides[i+1]
+	}
+
+	return c
+}
+
+func TestRequestWithValidTokenIsProxiedWithClaimHeaders(t *testing.T) {
+	expect := Expect{t}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	expect.Nil(err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	expect.Nil(err)
+
+	dir, err := ioutil.TempDir("", "cranker")
+	expect.Nil(err)
+	defer os.RemoveAll(dir)
+	jwks := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, jwks, map[string]interface{}{"rsa": rsaKey, "ec": ecKey})
+
+	var calls int32
+	c := &Connector{ServiceName: "auth", ServiceURL: newClaimsService(t, &calls), Auth: &JWTAuth{
+		JWKSFile:     jwks,
+		Issuer:       "https://issuer.test",
+		Audience:     []string{"orders"},
+		ClaimHeaders: map[string]string{"sub": "X-User", "roles": "X-Roles"},
+	}}
+	router := connectTest(t, c, 1)
+
+	resp, body := get(t, router.URL+"/auth/", "Authorization", "Bearer "+sign(t, "RS256", "rsa", rsaKey, claims()), "X-User", "mallory")
+	expect.Equal(http.StatusOK, resp.StatusCode)
+	expect.Equal("alice admin,ops", body)
+
+	resp, body = get(t, router.URL+"/auth/", "Authorization", "Bearer "+sign(t, "ES256", "ec", ecKey, claims("sub", "bob")))
+	expect.Equal(http.StatusOK, resp.StatusCode)
+	expect.Equal("bob admin,ops", body)
+	expect.Equal(int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestRequestWithoutValidTokenIsRejected(t *testing.T) {
+	expect := Expect{t}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	expect.Nil(err)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	expect.Nil(err)
+
+	var calls int32
+	c := &Connector{ServiceName: "auth", ServiceURL: newClaimsService(t, &calls), Auth: &JWTAuth{
+		Keys:     map[string]interface{}{"k1": &key.PublicKey, "hs": []byte("secret")},
+		Issuer:   "https://issuer.test",
+		Audience: []string{"orders"},
+	}}
+	router := connectTest(t, c, 1)
+
+	resp, _ := get(t, router.URL+"/auth/")
+	expect.Equal(http.StatusUnauthorized, resp.StatusCode)
+	expect.Equal("Bearer", resp.Header.Get("WWW-Authenticate"))
+
+	for name, token := range map[string]string{
+		"expired":       sign(t, "RS256", "k1", key, claims("exp", time.Now().Add(-time.Minute).Unix())),
+		"no exp":        sign(t, "RS256", "k1", key, claims("exp", nil)),
+		"issuer":        sign(t, "RS256", "k1", key, claims("iss", "https://other.test")),
+		"audience":      sign(t, "RS256", "k1", key, claims("aud", "billing")),
+		"signature":     sign(t, "RS256", "k1", otherKey, claims()),
+		"unknown kid":   sign(t, "RS256", "k2", key, claims()),
+		"alg none":      sign(t, "none", "k1", nil, claims()),
+		"alg confusion": sign(t, "HS256", "k1", []byte("secret"), claims()),
+		"malformed":     "not.a.jwt",
+	} {
+		t.Run(name, func(t *testing.T) {
+			expect := Expect{t}
+			resp, _ := get(t, router.URL+"/auth/", "Authorization", "Bearer "+token)
+			expect.Equal(http.StatusUnauthorized, resp.StatusCode)
+			expect.Equal(true, strings.HasPrefix(resp.Header.Get("WWW-Authenticate"), `Bearer error="invalid_token"`))
+		})
+	}
+
+	resp, _ = get(t, router.URL+"/auth/", "Authorization", "Bearer "+sign(t, "HS256", "hs", []byte("secret"), claims()))
+	expect.Equal(http.StatusOK, resp.StatusCode)
+	expect.Equal(int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestTokenWithoutRequiredScopeIsForbidden(t *testing.T) {
+	expect := Expect{t}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	expect.Nil(err)
+
+	var calls int32
+	c := &Connector{ServiceName: "auth", ServiceURL: newClaimsService(t, &calls), Auth: &JWTAuth{
+		Keys:   map[string]interface{}{"": key.Public()},
+		Scopes: []string{"orders:write"},
+	}}
+	router := connectTest(t, c, 1)
+
+	resp, _ := get(t, router.URL+"/auth/", "Authorization", "Bearer "+sign(t, "EdDSA", "", key, claims("scope", "orders:read")))
+	expect.Equal(http.StatusForbidden, resp.StatusCode)
+	expect.Equal(`Bearer error="insufficient_scope", error_description="requires scope orders:write"`, resp.Header.Get("WWW-Authenticate"))
+	expect.Equal(int32(0), atomic.LoadInt32(&calls))
+
+	resp, _ = get(t, router.URL+"/auth/", "Authorization", "Bearer "+sign(t, "EdDSA", "", key, claims("scope", nil, "scp", []string{"orders:write"})))
+	expect.Equal(http.StatusOK, resp.StatusCode)
+}
+
+func TestShutdownIsNotBlockedByTheBodyOfARejectedRequest(t *testing.T) {
+	expect := Expect{t}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	expect.Nil(err)
+
+	var calls int32
+	c := &Connector{
+		ServiceName:     "auth",
+		ServiceURL:      newClaimsService(t, &calls),
+		Auth:            &JWTAuth{Keys: map[string]interface{}{"k1": &key.PublicKey}},
+		ShutdownTimeout: 3 * time.Second,
+	}
+	router := connectTest(t, c, 1)
+
+	status, _ := send(t, http.MethodPost, router.URL+"/auth/", strings.NewReader("hello"))
+	expect.Equal(http.StatusUnauthorized, status)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	expect.Nil(c.ShutdownContext(ctx))
+	expect.Equal(int32(0), atomic.LoadInt32(&calls))
+}
+
+func TestInvalidJWTAuth(t *testing.T) {
+	expect := Expect{t}
+	discoverer := func() []string { return nil }
+
+	c := &Connector{ServiceName: "auth", ServiceURL: "http://localhost", Auth: &JWTAuth{}}
+	expect.Equal("JWTAuth requires JWKSFile or Keys", c.Connect(discoverer, 1).Error())
+
+	c = &Connector{ServiceName: "auth", ServiceURL: "http://localhost", Auth: &JWTAuth{Keys: map[string]interface{}{"k": "secret"}}}
+	expect.Equal(`invalid JWTAuth key "k": unsupported string`, c.Connect(discoverer, 1).Error())
+}
@@ -0,0 +1,148 @@
+package connector
+
+import (
+	"testing"
+	"time"
+)
+
+// newVersions returns the URLs of a stable service answering v1 and a canary service answering v2.
+func newVersions(t *testing.T) (string, string) {
+	stable := versionedService("v1", 0)
+	canary := versionedService("v2", 0)
+	t.Cleanup(func() {
+		stable.Close()
+		canary.Close()
+	})
+
+	return stable.URL, canary.URL
+}
+
+// getVersions gets url n times with the headers in pairs, and counts the responses by body.
+func getVersions(t *testing.T, url string, n int, headers ...string) map[string]int {
+	versions := map[string]int{}
+	for i := 0; i < n; i++ {
+		_, body := get(t, url, headers...)
+		versions[body]++
+	}
+
+	return versions
+}
+
+func TestCanaryWeightIsChangedWhileRunning(t *testing.T) {
+	expect := Expect{t}
+	stable, canary := newVersions(t)
+	c := &Connector{
+		ServiceName: "canary",
+		ServiceURL:  stable,
+		Canary:      &Canary{ServiceURLs: []string{canary}, Weight: 0},
+	}
+	router := connectTest(t, c, 1)
+
+	expect.Equal(map[string]int{"v1": 10}, getVersions(t, router.URL+"/canary/", 10))
+
+	expect.Nil(c.SetCanaryWeight(100))
+	expect.Equal(map[string]int{"v2": 10}, getVersions(t, router.URL+"/canary/", 10))
+
+	expect.Nil(c.SetCanaryWeight(30))
+	versions := getVersions(t, router.URL+"/canary/", 200)
+	expect.Equal(true, versions["v2"] > 30 && versions["v2"] < 90)
+
+	expect.Equal([]VersionStatus{
+		{Version: "stable", Weight: 70, Requests: uint64(10 + versions["v1"])},
+		{Version: "canary", Weight: 30, Requests: uint64(10 + versions["v2"])},
+	}, c.Status().Versions)
+	expect.Equal(2, len(c.Status().Upstreams))
+	expect.Equal("invalid Canary: Weight -1 not between 0 and 100", c.SetCanaryWeight(-1).Error())
+}
+
+func TestReconfigureCanary(t *testing.T) {
+	expect := Expect{t}
+	stable, canary := newVersions(t)
+	c := &Connector{
+		ServiceName: "canary",
+		ServiceURL:  stable,
+		Canary:      &Canary{ServiceURLs: []string{canary}, Weight: 100},
+	}
+	router := connectTest(t, c, 1)
+	expect.Equal(map[string]int{"v2": 3}, getVersions(t, router.URL+"/canary/", 3))
+
+	v3 := versionedService("v3", 0)
+	defer v3.Close()
+	cfg := c.Config()
+	cfg.Canary.ServiceURLs = []string{v3.URL}
+	cfg.Canary.Version = "v3"
+	expect.Nil(c.Reconfigure(cfg))
+	time.Sleep(500 * time.Millisecond)
+	expect.Equal(map[string]int{"v3": 3}, getVersions(t, router.URL+"/canary/", 3))
+
+	cfg.Canary = nil
+	expect.Nil(c.Reconfigure(cfg))
+	time.Sleep(500 * time.Millisecond)
+	expect.Equal(map[string]int{"v1": 3}, getVersions(t, router.URL+"/canary/", 3))
+	expect.Equal(0, len(c.Status().Versions))
+	expect.Equal("requires Canary", c.SetCanaryWeight(10).Error())
+}
+
+func TestStickyCookieKeepsAClientOnOneVersion(t *testing.T) {
+	expect := Expect{t}
+	stable, canary := newVersions(t)
+	c := &Connector{
+		ServiceName: "canary",
+		ServiceURL:  stable,
+		Canary:      &Canary{ServiceURLs: []string{canary}, Weight: 50, Sticky: "cookie:version", Version: "v2", StableVersion: "v1"},
+	}
+	router := connectTest(t, c, 1)
+
+	assigned := map[string]int{}
+	for i := 0; i < 20; i++ {
+		resp, body := get(t, router.URL+"/canary/")
+		cookies := resp.Cookies()
+		expect.Equal(1, len(cookies))
+		expect.Equal(body, cookies[0].Value)
+		assigned[body]++
+
+		expect.Equal(map[string]int{body: 5}, getVersions(t, router.URL+"/canary/", 5, "Cookie", "version="+body))
+	}
+	expect.Equal(2, len(assigned))
+
+	// no client is kept on a version which is rolled back.
+	expect.Nil(c.SetCanaryWeight(0))
+	resp, body := get(t, router.URL+"/canary/", "Cookie", "version=v2")
+	expect.Equal("v1", body)
+	expect.Equal("v1", resp.Cookies()[0].Value)
+}
+
+func TestStickyHeaderKeepsAUserOnOneVersion(t *testing.T) {
+	expect := Expect{t}
+	stable, canary := newVersions(t)
+	c := &Connector{
+		ServiceName: "canary",
+		ServiceURL:  stable,
+		Canary:      &Canary{ServiceURLs: []string{canary}, Weight: 50, Sticky: "header:X-User-Id"},
+	}
+	router := connectTest(t, c, 1)
+
+	assigned := map[string]int{}
+	for _, user := range []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi"} {
+		versions := getVersions(t, router.URL+"/canary/", 5, "X-User-Id", user)
+		expect.Equal(1, len(versions))
+		for version := range versions {
+			assigned[version]++
+		}
+	}
+	expect.Equal(2, len(assigned))
+}
+
+func TestInvalidCanary(t *testing.T) {
+	expect := Expect{t}
+	discoverer := func() []string { return nil }
+
+	c := &Connector{ServiceName: "canary", ServiceURL: "http://localhost", Canary: &Canary{ServiceURLs: []string{"http://canary"}, Weight: 101}}
+	expect.Equal("invalid Canary: Weight 101 not between 0 and 100", c.Connect(discoverer, 1).Error())
+
+	c = &Connector{ServiceName: "canary", ServiceURL: "http://localhost", Canary: &Canary{ServiceURLs: []string{"http://canary"}, Sticky: "ip"}}
+	expect.Equal(`invalid Canary: unknown Sticky "ip"`, c.Connect(discoverer, 1).Error())
+
+	c = &Connector{ServiceName: "canary", ServiceURL: "http://localhost", Canary: &Canary{}}
+	expect.Equal("invalid Canary: requires ServiceURLs", c.Connect(discoverer, 1).Error())
+}
@@ -0,0 +1,195 @@
+package connector
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JackKCWong/go-cranker-connector/internal/crankertest"
+)
+
+var largeJSON = `{"items": [` + strings.Repeat(`"item",`, 300) + `"item"]}`
+
+// newContentService answers body as contentType, with the headers in pairs.
+func newContentService(t *testing.T, contentType, body string, headers ...string) string {
+	service := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", contentType)
+		for i := 0; i < len(headers); i += 2 {
+			rw.Header().Set(headers[i], headers[i+1])
+		}
+		_, _ = rw.Write([]byte(body))
+	}))
+	t.Cleanup(service.Close)
+
+	return service.URL
+}
+
+// getEncoded gets url with acceptEncoding, without decompressing the response.
+func getEncoded(t *testing.T, router *crankertest.Router, acceptEncoding string) (*http.Response, string) {
+	if !router.WaitIdle("compression", 5*time.Second, func(n int) bool { return n == 1 }) {
+		t.Fatal("connector didn't reconnect")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, router.URL+"/compression/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, string(body)
+}
+
+func gunzip(t *testing.T, s string) string {
+	gz, err := gzip.NewReader(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(body)
+}
+
+func TestResponseIsCompressedWhenAccepted(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{
+		ServiceName: "compression",
+		ServiceURL:  newContentService(t, "application/json", largeJSON, "ETag", `"v1"`),
+		Compression: &Compression{},
+	}
+	router := connectTest(t, c, 1)
+
+	resp, body := getEncoded(t, router, "br;q=1.0, gzip;q=0.8")
+	expect.Equal("gzip", resp.Header.Get("Content-Encoding"))
+	expect.Equal("Accept-Encoding", resp.Header.Get("Vary"))
+	expect.Equal(`W/"v1"`, resp.Header.Get("ETag"))
+	expect.Equal(true, len(body) < len(largeJSON))
+	expect.Equal(largeJSON, gunzip(t, body))
+
+	resp, body = getEncoded(t, router, "*")
+	expect.Equal("gzip", resp.Header.Get("Content-Encoding"))
+	expect.Equal(largeJSON, gunzip(t, body))
+}
+
+func TestResponseIsNotCompressedWhenNotAccepted(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{
+		ServiceName: "compression",
+		ServiceURL:  newContentService(t, "text/plain", largeJSON),
+		Compression: &Compression{},
+	}
+	router := connectTest(t, c, 1)
+
+	for _, acceptEncoding := range []string{"identity", "gzip;q=0", "*, gzip;q=0", "deflate"} {
+		resp, body := getEncoded(t, router, acceptEncoding)
+		expect.Equal("", resp.Header.Get("Content-Encoding"))
+		expect.Equal(largeJSON, body)
+	}
+}
+
+func TestResponseIsCompressedAsPerContentTypeAndSize(t *testing.T) {
+	expect := Expect{t}
+	compression := &Compression{ContentTypes: []string{"application/"}, MinSize: 100}
+
+	c := &Connector{
+		ServiceName: "compression",
+		ServiceURL:  newContentService(t, "application/x-ndjson", largeJSON),
+		Compression: compression,
+	}
+	router := connectTest(t, c, 1)
+	resp, _ := getEncoded(t, router, "gzip")
+	expect.Equal("gzip", resp.Header.Get("Content-Encoding"))
+
+	c = &Connector{
+		ServiceName: "compression",
+		ServiceURL:  newContentService(t, "text/plain", largeJSON),
+		Compression: compression,
+	}
+	router = connectTest(t, c, 1)
+	resp, _ = getEncoded(t, router, "gzip")
+	expect.Equal("", resp.Header.Get("Content-Encoding"))
+
+	c = &Connector{
+		ServiceName: "compression",
+		ServiceURL:  newContentService(t, "application/json", `{"small": true}`),
+		Compression: compression,
+	}
+	router = connectTest(t, c, 1)
+	resp, body := getEncoded(t, router, "gzip")
+	expect.Equal("", resp.Header.Get("Content-Encoding"))
+	expect.Equal(`{"small": true}`, body)
+}
+
+func TestEncodedResponseIsSentAsIs(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{
+		ServiceName: "compression",
+		ServiceURL:  newContentService(t, "application/json", largeJSON, "Content-Encoding", "br"),
+		Compression: &Compression{},
+	}
+	router := connectTest(t, c, 1)
+
+	resp, body := getEncoded(t, router, "gzip, br")
+	expect.Equal("br", resp.Header.Get("Content-Encoding"))
+	expect.Equal(largeJSON, body)
+}
+
+func TestCompressedResponseIsStreamed(t *testing.T) {
+	expect := Expect{t}
+	release := make(chan struct{})
+	defer close(release)
+	service := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		_, _ = rw.Write([]byte("data: first\n\n"))
+		rw.(http.Flusher).Flush()
+		<-release
+		_, _ = rw.Write([]byte("data: last\n\n"))
+	}))
+	t.Cleanup(service.Close)
+
+	c := &Connector{
+		ServiceName: "compression",
+		ServiceURL:  service.URL,
+		Compression: &Compression{},
+	}
+	router := connectTest(t, c, 1)
+
+	req, err := http.NewRequest(http.MethodGet, router.URL+"/compression/", nil)
+	expect.Nil(err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	expect.Nil(err)
+	defer resp.Body.Close()
+	expect.Equal("gzip", resp.Header.Get("Content-Encoding"))
+
+	gz, err := gzip.NewReader(resp.Body)
+	expect.Nil(err)
+	line, err := bufio.NewReader(gz).ReadString('\n')
+	expect.Nil(err)
+	expect.Equal("data: first\n", line)
+}
+
+func TestInvalidCompressionLevel(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{ServiceName: "compression", ServiceURL: "http://localhost", Compression: &Compression{Level: 10}}
+	expect.Equal("invalid Compression.Level 10", c.Connect(func() []string { return nil }, 1).Error())
+}
@@ -0,0 +1,158 @@
+package connector
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// closedURL is the url of a port nothing listens on.
+func closedURL(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Close()
+
+	return "http://" + l.Addr().String()
+}
+
+func getProblem(t *testing.T, url string) (*http.Response, problemDetails) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var p problemDetails
+	err = json.NewDecoder(resp.Body).Decode(&p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, p
+}
+
+type problemDetails struct {
+	Type    string `json:"type"`
+	Title   string `json:"title"`
+	Status  int    `json:"status"`
+	Detail  string `json:"detail"`
+	ErrorID string `json:"errorId"`
+}
+
+func TestRefusedConnectionIsABadGateway(t *testing.T) {
+	expect := Expect{t}
+	router := connectTest(t, &Connector{ServiceName: "errors", ServiceURL: closedURL(t)}, 1)
+
+	resp, p := getProblem(t, router.URL+"/errors/")
+
+	expect.Equal(http.StatusBadGateway, resp.StatusCode)
+	expect.Equal("application/problem+json", resp.Header.Get("Content-Type"))
+	expect.Equal("about:blank", p.Type)
+	expect.Equal("Bad Gateway", p.Title)
+	expect.Equal(http.StatusBadGateway, p.Status)
+	expect.Equal(36, len(p.ErrorID))
+}
+
+func TestServiceTimeoutIsAGatewayTimeout(t *testing.T) {
+	expect := Expect{t}
+	service := versionedService("slow", time.Second)
+	defer service.Close()
+	router := connectTest(t, &Connector{
+		ServiceName:       "errors",
+		ServiceURL:        service.URL,
+		ServiceHttpClient: &http.Client{Timeout: 100 * time.Millisecond},
+	}, 1)
+
+	resp, p := getProblem(t, router.URL+"/errors/")
+
+	expect.Equal(http.StatusGatewayTimeout, resp.StatusCode)
+	expect.Equal("Gateway Timeout", p.Title)
+	expect.Equal(http.StatusGatewayTimeout, p.Status)
+}
+
+func TestServiceFailingWhileShuttingDownIsUnavailable(t *testing.T) {
+	expect := Expect{t}
+	held, release := make(chan struct{}), make(chan struct{})
+	service := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		close(held)
+		<-release
+		conn, _, _ := rw.(http.Hijacker).Hijack()
+		_ = conn.Close()
+	}))
+	defer service.Close()
+	c := &Connector{ServiceName: "errors", ServiceURL: service.URL}
+	router := connectTest(t, c, 1)
+
+	problems := make(chan problemDetails)
+	go func() {
+		_, p := getProblem(t, router.URL+"/errors/")
+		problems <- p
+	}()
+
+	<-held
+	drained := make(chan error)
+	go func() {
+		drained <- c.Drain(context.Background())
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	p := <-problems
+	expect.Equal(http.StatusServiceUnavailable, p.Status)
+	expect.Equal("Service Unavailable", p.Title)
+	expect.Nil(<-drained)
+}
+
+func TestErrorPageTemplate(t *testing.T) {
+	expect := Expect{t}
+	router := connectTest(t, &Connector{
+		ServiceName: "errors",
+		ServiceURL:  closedURL(t),
+		ErrorPages: ErrorPages{
+			Template: template.Must(template.New("error").Parse(`<h1>{{.StatusCode}} {{.Title}}</h1>{{.ErrorID | len}}`)),
+		},
+	}, 1)
+
+	resp, err := http.Get(router.URL + "/errors/")
+	expect.Nil(err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	expect.Nil(err)
+
+	expect.Equal(http.StatusBadGateway, resp.StatusCode)
+	expect.Equal("text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	expect.Equal("<h1>502 Bad Gateway</h1>36", string(body))
+}
+
+func TestErrorPageRender(t *testing.T) {
+	expect := Expect{t}
+	router := connectTest(t, &Connector{
+		ServiceName: "errors",
+		ServiceURL:  closedURL(t),
+		ErrorPages: ErrorPages{
+			Render: func(rw http.ResponseWriter, req *http.Request, err *ProxyError) {
+				rw.Header().Set("X-Error-Id", err.ErrorID)
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				_, _ = rw.Write([]byte("sorry, " + req.URL.Path + " is down"))
+			},
+		},
+	}, 1)
+
+	resp, err := http.Get(router.URL + "/errors/page")
+	expect.Nil(err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	expect.Nil(err)
+
+	expect.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	expect.Equal(36, len(resp.Header.Get("X-Error-Id")))
+	expect.Equal("sorry, /page is down", string(body))
+}
@@ -0,0 +1,133 @@
+package connector
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/JackKCWong/go-cranker-connector/internal/crankertest"
+)
+
+// newHeaderService answers the headers of the requests, after setting hop-by-hop headers in the response.
+func newHeaderService(t *testing.T) string {
+	service := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Connection", "X-Internal")
+		rw.Header().Set("X-Internal", "secret")
+		rw.Header().Set("Keep-Alive", "timeout=5")
+		_ = json.NewEncoder(rw).Encode(req.Header)
+	}))
+	t.Cleanup(service.Close)
+
+	return service.URL
+}
+
+func getForwarded(t *testing.T, router *crankertest.Router, header http.Header) (http.Header, *http.Response) {
+	req, err := http.NewRequest(http.MethodGet, router.URL+"/fwd/path", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "example.com:8080"
+	req.Header = header
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	received := http.Header{}
+	err = json.NewDecoder(resp.Body).Decode(&received)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return received, resp
+}
+
+func forgedHeaders() http.Header {
+	return http.Header{
+		"Connection":         {"X-Custom"},
+		"X-Custom":           {"dropped"},
+		"Keep-Alive":         {"timeout=5"},
+		"Te":                 {"trailers"},
+		"X-Forwarded-For":    {"203.0.113.7"},
+		"X-Forwarded-Proto":  {"https"},
+		"X-Forwarded-Host":   {"public.example.com"},
+		"X-Forwarded-Prefix": {"/outer"},
+		"Forwarded":          {`for=203.0.113.7;proto=https`},
+	}
+}
+
+func TestForwardingHeadersOfTrustedRouterArePreserved(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{
+		ServiceName: "fwd",
+		ServiceURL:  newHeaderService(t),
+		Forwarding:  Forwarding{TrustedProxies: []string{"127.0.0.0/8"}},
+	}
+	router := connectTest(t, c, 1)
+
+	received, resp := getForwarded(t, router, forgedHeaders())
+
+	expect.Equal("", received.Get("Connection"))
+	expect.Equal("", received.Get("X-Custom"))
+	expect.Equal("", received.Get("Keep-Alive"))
+	expect.Equal("trailers", received.Get("Te"))
+	expect.Equal("203.0.113.7, 127.0.0.1", received.Get("X-Forwarded-For"))
+	expect.Equal("https", received.Get("X-Forwarded-Proto"))
+	expect.Equal("public.example.com", received.Get("X-Forwarded-Host"))
+	expect.Equal("/outer/fwd", received.Get("X-Forwarded-Prefix"))
+	expect.Equal(`for=203.0.113.7;proto=https, for=127.0.0.1;host="example.com:8080";proto=http`, received.Get("Forwarded"))
+
+	expect.Equal("", resp.Header.Get("X-Internal"))
+	expect.Equal("", resp.Header.Get("Keep-Alive"))
+}
+
+func TestForwardingHeadersOfUntrustedRouterAreOverwritten(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{
+		ServiceName: "fwd",
+		ServiceURL:  newHeaderService(t),
+		Forwarding:  Forwarding{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1"}, Proto: "https"},
+	}
+	router := connectTest(t, c, 1)
+
+	received, _ := getForwarded(t, router, forgedHeaders())
+
+	expect.Equal("127.0.0.1", received.Get("X-Forwarded-For"))
+	expect.Equal("https", received.Get("X-Forwarded-Proto"))
+	expect.Equal("example.com:8080", received.Get("X-Forwarded-Host"))
+	expect.Equal("/fwd", received.Get("X-Forwarded-Prefix"))
+	expect.Equal(`for=127.0.0.1;host="example.com:8080";proto=https`, received.Get("Forwarded"))
+}
+
+func TestForwardingHeadersAreSetWithoutProxyInFront(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{
+		ServiceName: "fwd",
+		ServiceURL:  newHeaderService(t),
+		Forwarding:  Forwarding{Overwrite: true},
+	}
+	router := connectTest(t, c, 1)
+
+	received, _ := getForwarded(t, router, http.Header{})
+
+	expect.Equal("127.0.0.1", received.Get("X-Forwarded-For"))
+	expect.Equal("http", received.Get("X-Forwarded-Proto"))
+	expect.Equal("example.com:8080", received.Get("X-Forwarded-Host"))
+	expect.Equal("/fwd", received.Get("X-Forwarded-Prefix"))
+	expect.Equal(`for=127.0.0.1;host="example.com:8080";proto=http`, received.Get("Forwarded"))
+	expect.Equal("", received.Get("Te"))
+}
+
+func TestInvalidTrustedProxiesAreRejected(t *testing.T) {
+	c := &Connector{
+		ServiceName: "fwd",
+		ServiceURL:  "http://localhost",
+		Forwarding:  Forwarding{TrustedProxies: []string{"10.0.0.0/33"}},
+	}
+
+	err := c.Connect(func() []string { return nil }, 1)
+	Expect{t}.Equal(`invalid TrustedProxies: "10.0.0.0/33"`, err.Error())
+}
@@ -0,0 +1,235 @@
+package connector
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// grpcFrame returns msg as a length-prefixed gRPC message.
+func grpcFrame(msg string) []byte {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// readGrpcFrame reads a length-prefixed gRPC message from r.
+func readGrpcFrame(r io.Reader) (string, error) {
+	prefix := make([]byte, 5)
+	_, err := io.ReadFull(r, prefix)
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	_, err = io.ReadFull(r, msg)
+
+	return string(msg), err
+}
+
+// newGrpcService returns the h2c:// URL of a service which echoes every message of a stream as soon as it's received,
+// and then answers with the grpc-status trailer. A "fail" first message is answered with a trailers-only response.
+func newGrpcService(t *testing.T) string {
+	service := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 || req.Header.Get("Content-Type") != "application/grpc" || req.Header.Get("Te") != "trailers" {
+			http.Error(rw, "not a gRPC request", http.StatusBadRequest)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/grpc")
+		rw.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		for n := 0; ; n++ {
+			msg, err := readGrpcFrame(req.Body)
+			if err == io.EOF {
+				rw.Header().Set("Grpc-Status", "0")
+				rw.Header().Set("Grpc-Message", strings.Repeat("x", n))
+				return
+			}
+			if err != nil || msg == "fail" && n == 0 {
+				rw.Header().Del("Trailer")
+				rw.Header().Set("Grpc-Status", "5")
+				rw.Header().Set("Grpc-Message", "not found")
+				rw.WriteHeader(http.StatusOK)
+				return
+			}
+
+			_, _ = rw.Write(grpcFrame("echo " + msg))
+			rw.(http.Flusher).Flush()
+		}
+	}), &http2.Server{}))
+	t.Cleanup(service.Close)
+
+	return "h2c://" + strings.TrimPrefix(service.URL, "http://")
+}
+
+// h2cClient speaks HTTP/2 without TLS to the router, as gRPC clients do.
+var h2cClient = &http.Client{Transport: &http2.Transport{
+	AllowHTTP: true,
+	DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	},
+}}
+
+// call starts a gRPC-style call to url with a first message, the rest of the request body is written to the returned pipe.
+func call(t *testing.T, url, first string) (*io.PipeWriter, *http.Response) {
+	in, out := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, url, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Te", "trailers")
+
+	// the service answers once it gets the first message.
+	go func() { _, _ = out.Write(grpcFrame(first)) }()
+
+	resp, err := h2cClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+
+	return out, resp
+}
+
+func TestGrpcStreamIsProxiedToAnH2CService(t *testing.T) {
+	expect := Expect{t}
+	router := connectTest(t, &Connector{ServiceName: "grpc", ServiceURL: newGrpcService(t)}, 1)
+
+	in, resp := call(t, router.URL+"/grpc/echo.Echo/Stream", "first")
+	expect.Equal(http.StatusOK, resp.StatusCode)
+	expect.Equal("application/grpc", resp.Header.Get("Content-Type"))
+
+	// each message is echoed while the request is still streaming.
+	for _, msg := range []string{"second", "third"} {
+		echoed, err := readGrpcFrame(resp.Body)
+		expect.Nil(err)
+		expect.Equal(true, strings.HasPrefix(echoed, "echo "))
+
+		_, err = in.Write(grpcFrame(msg))
+		expect.Nil(err)
+	}
+	expect.Nil(in.Close())
+
+	echoed, err := readGrpcFrame(resp.Body)
+	expect.Nil(err)
+	expect.Equal("echo third", echoed)
+	_, err = readGrpcFrame(resp.Body)
+	expect.Equal(io.EOF, err)
+}
+
+func TestGrpcTrailersOnlyResponseIsProxied(t *testing.T) {
+	expect := Expect{t}
+	router := connectTest(t, &Connector{ServiceName: "grpc", ServiceURL: newGrpcService(t)}, 1)
+
+	_, resp := call(t, router.URL+"/grpc/echo.Echo/Stream", "fail")
+	_, err := readGrpcFrame(resp.Body)
+	expect.Equal(io.EOF, err)
+	expect.Equal("5", resp.Header.Get("Grpc-Status"))
+	expect.Equal("not found", resp.Header.Get("Grpc-Message"))
+}
+
+func TestLargeBodyIsEchoedByAnH2CService(t *testing.T) {
+	expect := Expect{t}
+	service := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = io.Copy(rw, req.Body)
+	}), &http2.Server{}))
+	defer service.Close()
+	router := connectTest(t, &Connector{ServiceName: "grpc", ServiceURL: "h2c://" + strings.TrimPrefix(service.URL, "http://")}, 1)
+
+	body := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	resp, err := h2cClient.Post(router.URL+"/grpc/echo", "application/octet-stream", bytes.NewReader(body))
+	expect.Nil(err)
+	defer resp.Body.Close()
+
+	echoed, err := ioutil.ReadAll(resp.Body)
+	expect.Nil(err)
+	expect.Equal(len(body), len(echoed))
+	expect.Equal(true, bytes.Equal(body, echoed))
+}
+
+func TestTrailersOfH2CResponsesAreForwarded(t *testing.T) {
+	expect := Expect{t}
+	router := connectRouter(t, trailersRouter(), &Connector{ServiceName: "grpc", ServiceURL: newGrpcService(t)}, 1)
+
+	in, resp := call(t, router.URL+"/grpc/echo.Echo/Stream", "first")
+	expect.Nil(in.Close())
+
+	echoed, err := readGrpcFrame(resp.Body)
+	expect.Nil(err)
+	expect.Equal("echo first", echoed)
+	_, err = readGrpcFrame(resp.Body)
+	expect.Equal(io.EOF, err)
+	expect.Equal("0", resp.Trailer.Get("Grpc-Status"))
+	expect.Equal("x", resp.Trailer.Get("Grpc-Message"))
+}
+
+func TestTrailersOfH2CResponsesAreDroppedForARouterNotTakingThem(t *testing.T) {
+	expect := Expect{t}
+	router := connectTest(t, &Connector{ServiceName: "grpc", ServiceURL: newGrpcService(t)}, 1)
+
+	in, resp := call(t, router.URL+"/grpc/echo.Echo/Stream", "first")
+	expect.Nil(in.Close())
+	expect.Equal("", resp.Header.Get("Trailer"))
+
+	echoed, err := readGrpcFrame(resp.Body)
+	expect.Nil(err)
+	expect.Equal("echo first", echoed)
+	_, err = readGrpcFrame(resp.Body)
+	expect.Equal(io.EOF, err)
+	expect.Equal(0, len(resp.Trailer))
+}
+
+func TestH2CConnectionsAreClosedOnceReconfigured(t *testing.T) {
+	expect := Expect{t}
+	var closed int32
+	h2cHandler := h2c.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(req.Proto))
+	}), &http2.Server{})
+	service := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		h2cHandler.ServeHTTP(rw, req)
+		if req.Method == "PRI" {
+			// the preface of an h2c connection is served until the connection is closed.
+			atomic.AddInt32(&closed, 1)
+		}
+	}))
+	t.Cleanup(service.Close)
+
+	c := &Connector{ServiceName: "grpc", ServiceURL: "h2c://" + strings.TrimPrefix(service.URL, "http://")}
+	router := connectTest(t, c, 1)
+	expect.Equal("HTTP/2.0", getBody(t, router.URL+"/grpc/"))
+
+	// the idle connection of the previous settings is closed once they retire, the new ones get a new connection.
+	expect.Equal(true, router.WaitIdle("grpc", 5*time.Second, func(n int) bool { return n == 1 }))
+	registered := router.Registered("grpc")
+	expect.Nil(c.Reconfigure(c.Config()))
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&closed) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	expect.Equal(int32(1), atomic.LoadInt32(&closed))
+	// the socket of the previous settings may still be idle in the router until it's closed.
+	expect.Equal(true, router.WaitIdle("grpc", 5*time.Second, func(n int) bool { return n == 1 && router.Registered("grpc") > registered }))
+	expect.Equal("HTTP/2.0", getBody(t, router.URL+"/grpc/"))
+}
+
+func TestInvalidH2CServiceURL(t *testing.T) {
+	expect := Expect{t}
+	discoverer := func() []string { return nil }
+
+	c := &Connector{ServiceName: "grpc", ServiceURL: "h2c://localhost:%zz"}
+	expect.Equal(true, strings.HasPrefix(c.Connect(discoverer, 1).Error(), "invalid ServiceURL: "))
+}
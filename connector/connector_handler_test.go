@@ -0,0 +1,133 @@
+package connector
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHandlerServesRequestsInProcess(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{ServiceName: "inproc", Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		rw.Header().Set("X-Path", req.URL.Path)
+		rw.Header().Set("X-Request-URI", req.RequestURI)
+		rw.WriteHeader(http.StatusCreated)
+		_, _ = rw.Write([]byte("<html>" + string(body) + "</html>"))
+	})}
+	router := connectTest(t, c, 2)
+
+	resp, err := http.Post(router.URL+"/inproc/echo?q=1", "text/plain", strings.NewReader("hello"))
+	expect.Nil(err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	expect.Nil(err)
+	expect.Equal(http.StatusCreated, resp.StatusCode)
+	expect.Equal("/echo", resp.Header.Get("X-Path"))
+	expect.Equal("/echo?q=1", resp.Header.Get("X-Request-URI"))
+	expect.Equal("text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	expect.Equal("<html>hello</html>", string(body))
+}
+
+func TestHandlerFlushStreamsToTheClient(t *testing.T) {
+	expect := Expect{t}
+	next := make(chan struct{})
+	c := &Connector{ServiceName: "inproc", Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		for i := 0; i < 3; i++ {
+			_, _ = rw.Write([]byte("chunk\n"))
+			rw.(http.Flusher).Flush()
+			<-next
+		}
+	})}
+	router := connectTest(t, c, 2)
+
+	resp, err := http.Get(router.URL + "/inproc/stream")
+	expect.Nil(err)
+	defer resp.Body.Close()
+
+	lines := bufio.NewReader(resp.Body)
+	for i := 0; i < 3; i++ {
+		line, err := lines.ReadString('\n')
+		expect.Nil(err)
+		expect.Equal("chunk\n", line)
+		next <- struct{}{}
+	}
+}
+
+func TestHandlerHijackIsRefused(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{ServiceName: "inproc", Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _, err := rw.(http.Hijacker).Hijack()
+		if err != http.ErrNotSupported {
+			t.Errorf("expected ErrNotSupported, got %v", err)
+		}
+		rw.WriteHeader(http.StatusNotImplemented)
+	})}
+	router := connectTest(t, c, 2)
+
+	resp, err := http.Get(router.URL + "/inproc/upgrade")
+	expect.Nil(err)
+	resp.Body.Close()
+	expect.Equal(http.StatusNotImplemented, resp.StatusCode)
+}
+
+func TestHandlerTrailersWithoutBodyAreSentAsHeaders(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{ServiceName: "inproc", Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Trailer", "X-Checksum")
+		rw.Header().Set("X-Checksum", "abc")
+		rw.Header().Set(http.TrailerPrefix+"X-Late", "def")
+	})}
+	router := connectTest(t, c, 2)
+
+	resp, err := http.Get(router.URL + "/inproc/trailers")
+	expect.Nil(err)
+	resp.Body.Close()
+
+	expect.Equal(http.StatusOK, resp.StatusCode)
+	expect.Equal("abc", resp.Header.Get("X-Checksum"))
+	expect.Equal("def", resp.Header.Get("X-Late"))
+	expect.Equal("", resp.Header.Get("Trailer"))
+	expect.Equal(int64(0), resp.ContentLength)
+}
+
+func TestHandlerTrailersAfterBodyAreNotAnnounced(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{ServiceName: "inproc", Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Trailer", "X-Checksum")
+		_, _ = rw.Write([]byte("body"))
+		rw.Header().Set("X-Checksum", "abc")
+	})}
+	router := connectTest(t, c, 2)
+
+	resp, err := http.Get(router.URL + "/inproc/trailers")
+	expect.Nil(err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	expect.Nil(err)
+	expect.Equal("body", string(body))
+	expect.Equal("", resp.Header.Get("Trailer"))
+	expect.Equal("", resp.Header.Get("X-Checksum"))
+}
+
+func TestHandlerPanicAbortsTheResponse(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{ServiceName: "inproc", Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/panic" {
+			panic("boom")
+		}
+		_, _ = rw.Write([]byte("ok"))
+	})}
+	router := connectTest(t, c, 2)
+
+	resp, err := http.Get(router.URL + "/inproc/panic")
+	expect.Nil(err)
+	resp.Body.Close()
+	expect.Equal(http.StatusBadGateway, resp.StatusCode)
+
+	expect.Equal("ok", getBody(t, router.URL+"/inproc/fine"))
+}
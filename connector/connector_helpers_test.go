@@ -0,0 +1,97 @@
+package connector
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JackKCWong/go-cranker-connector/internal/crankertest"
+)
+
+// connectTest connects c to a new router and waits for its slidingWindow idle sockets.
+// c is shut down and the router closed when the test ends. ShutdownTimeout is a second unless set.
+func connectTest(t *testing.T, c *Connector, slidingWindow int8) *crankertest.Router {
+	return connectRouter(t, crankertest.NewRouter(), c, slidingWindow)
+}
+
+// connectRouter is connectTest with a router set up by the test, e.g. with Trailers.
+func connectRouter(t *testing.T, router *crankertest.Router, c *Connector, slidingWindow int8) *crankertest.Router {
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = time.Second
+	}
+	t.Cleanup(func() {
+		c.Shutdown()
+		router.Close()
+	})
+
+	err := c.Connect(func() []string { return []string{router.RegisterURL()} }, slidingWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !router.WaitIdle(c.ServiceName, 5*time.Second, func(n int) bool { return n == int(slidingWindow) }) {
+		t.Fatal("connector didn't register")
+	}
+
+	return router
+}
+
+func versionedService(version string, delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(delay)
+		_, _ = rw.Write([]byte(version))
+	}))
+}
+
+// get gets url with the headers in pairs.
+func get(t *testing.T, url string, headers ...string) (*http.Response, string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	return do(t, req)
+}
+
+func getBody(t *testing.T, url string) string {
+	_, body := get(t, url)
+	return body
+}
+
+func send(t *testing.T, method, url string, body io.Reader) (int, string) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, respBody := do(t, req)
+	return resp.StatusCode, respBody
+}
+
+// do sends req and reads the whole response body.
+func do(t *testing.T, req *http.Request) (*http.Response, string) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, string(body)
+}
+
+// streamed hides the length of s, so that it's sent chunked.
+func streamed(s string) io.Reader {
+	return struct{ io.Reader }{strings.NewReader(s)}
+}
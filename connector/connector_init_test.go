@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"github.com/JackKCWong/go-cranker-connector/internal/crankertest"
 	"github.com/JackKCWong/go-cranker-connector/internal/util"
 	"github.com/mccutchen/go-httpbin/v2/httpbin"
 	"github.com/rs/zerolog"
@@ -31,7 +32,9 @@ var (
 	tlsSkipVerify   *tls.Config
 	connector       *Connector
 	crankerURL      string
+	crankerWSS      string
 	testServiceName string
+	testRouter      *crankertest.Router
 )
 
 func TestMain(t *testing.M) {
@@ -42,6 +45,9 @@ func TestMain(t *testing.M) {
 
 func tearDown() {
 	connector.Shutdown()
+	if testRouter != nil {
+		testRouter.Close()
+	}
 }
 
 func setup() {
@@ -62,8 +68,16 @@ func setup() {
 	}
 
 	crankerURL = os.Getenv("CRANKER_TEST_URL")
+	crankerWSS = os.Getenv("CRANKER_TEST_WSS_URL")
 	if crankerURL == "" {
-		crankerURL = "https://localhost:8443"
+		// no external cranker, run against an in-process one.
+		testRouter = crankertest.NewRouter()
+		crankerURL = testRouter.URL
+		crankerWSS = testRouter.RegisterURL()
+	}
+
+	if crankerWSS == "" {
+		crankerWSS = "wss://localhost:16489/register"
 	}
 
 	testServiceName = os.Getenv("CRANKER_TEST_SERVICE")
@@ -84,11 +98,6 @@ func setup() {
 	}
 
 	err := connector.Connect(func() []string {
-		crankerWSS := os.Getenv("CRANKER_TEST_WSS_URL")
-		if crankerWSS == "" {
-			crankerWSS = "wss://localhost:16489/register"
-		}
-
 		return []string{crankerWSS}
 	}, 2)
 
@@ -0,0 +1,308 @@
+package connector
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JackKCWong/go-cranker-connector/internal/crankertest"
+	"github.com/mccutchen/go-httpbin/v2/httpbin"
+)
+
+func TestDrainDeregistersAndWaitsForInFlightRequests(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{ServiceName: "lifecycle", ServiceURL: testServer.URL, ShutdownTimeout: 3 * time.Second}
+	router := connectTest(t, c, 2)
+
+	inflight := make(chan *http.Response)
+	go func() {
+		resp, err := http.Get(router.URL + "/lifecycle/delay/1")
+		expect.Nil(err)
+		inflight <- resp
+	}()
+
+	// the busy socket is replaced once the request is picked up
+	time.Sleep(200 * time.Millisecond)
+	expect.Equal(true, router.WaitIdle("lifecycle", 5*time.Second, func(n int) bool { return n == 2 }))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	expect.Nil(c.Drain(ctx))
+
+	expect.Equal([]string{c.instanceID}, router.Deregistered())
+	expect.Equal(0, router.Idle("lifecycle"))
+
+	resp := <-inflight
+	expect.Equal(200, resp.StatusCode)
+	resp.Body.Close()
+
+	router.IdleWait = 100 * time.Millisecond
+	resp, err := http.Get(router.URL + "/lifecycle/get")
+	expect.Nil(err)
+	expect.Equal(503, resp.StatusCode)
+	resp.Body.Close()
+
+	c.Shutdown()
+}
+
+func TestDrainReturnsWhenContextIsDoneWithoutCancellingRequests(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{ServiceName: "lifecycle", ServiceURL: testServer.URL, ShutdownTimeout: 3 * time.Second}
+	router := connectTest(t, c, 1)
+
+	inflight := make(chan *http.Response)
+	go func() {
+		resp, err := http.Get(router.URL + "/lifecycle/delay/1")
+		expect.Nil(err)
+		inflight <- resp
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	expect.Equal(context.DeadlineExceeded, c.Drain(ctx))
+
+	resp := <-inflight
+	expect.Equal(200, resp.StatusCode)
+	resp.Body.Close()
+
+	c.Shutdown()
+}
+
+func TestConnectReturnsValidationErrorsWithoutHoldingTheLock(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{ServiceName: "lifecycle"}
+
+	discoverer := func() []string { return nil }
+	expect.Equal("requires ServiceURL", c.Connect(discoverer, 1).Error())
+	expect.Equal("requires ServiceURL", c.Connect(discoverer, 1).Error())
+	expect.Equal(stateNew, c.state)
+}
+
+func TestConnectTwiceIsRejected(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{ServiceName: "lifecycle", ServiceURL: testServer.URL, ShutdownTimeout: 3 * time.Second}
+	router := connectTest(t, c, 1)
+
+	expect.Equal(ErrAlreadyConnected, c.Connect(func() []string { return []string{router.RegisterURL()} }, 1))
+	c.Shutdown()
+}
+
+func TestShutdownWithoutConnect(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{}
+
+	c.Shutdown()
+	<-c.Done()
+	expect.Nil(c.Err())
+	expect.Nil(c.Drain(context.Background()))
+}
+
+func TestRunBlocksUntilContextIsDone(t *testing.T) {
+	expect := Expect{t}
+	service := httptest.NewServer(httpbin.New().Handler())
+	router := crankertest.NewRouter()
+	defer service.Close()
+	defer router.Close()
+
+	c := &Connector{ServiceName: "lifecycle", ServiceURL: service.URL}
+	ctx, cancel := context.WithCancel(context.Background())
+	ran := make(chan error)
+	go func() {
+		ran <- c.Run(ctx, func() []string { return []string{router.RegisterURL()} }, 1)
+	}()
+
+	expect.Equal(true, router.WaitIdle("lifecycle", 5*time.Second, func(n int) bool { return n == 1 }))
+
+	resp, err := http.Get(router.URL + "/lifecycle/get")
+	expect.Nil(err)
+	expect.Equal(200, resp.StatusCode)
+	resp.Body.Close()
+
+	select {
+	case <-ran:
+		t.Fatal("Run returned before ctx is done")
+	case <-c.Done():
+		t.Fatal("Done closed before ctx is done")
+	default:
+	}
+
+	cancel()
+	expect.Nil(<-ran)
+	<-c.Done()
+	expect.Equal(stateStopped, c.state)
+}
+
+func TestShutdownContextHonoursDeadline(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{ServiceName: "lifecycle", ServiceURL: testServer.URL, ShutdownTimeout: 3 * time.Second}
+	router := connectTest(t, c, 1)
+
+	inflight := make(chan int)
+	go func() {
+		resp, err := http.Get(router.URL + "/lifecycle/delay/3")
+		if err != nil {
+			inflight <- 0
+			return
+		}
+		resp.Body.Close()
+		inflight <- resp.StatusCode
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	expect.Equal(context.DeadlineExceeded, c.ShutdownContext(ctx))
+	expect.Equal(true, time.Since(start) < 2*time.Second)
+
+	<-c.Done()
+	expect.Equal(context.DeadlineExceeded, c.Err())
+	expect.Equal(http.StatusBadGateway, <-inflight)
+}
+
+func TestConcurrentConnectAndShutdown(t *testing.T) {
+	service := httptest.NewServer(httpbin.New().Handler())
+	router := crankertest.NewRouter()
+	defer service.Close()
+	defer router.Close()
+
+	for i := 0; i < 10; i++ {
+		c := &Connector{ServiceName: "lifecycle", ServiceURL: service.URL, ShutdownTimeout: time.Second}
+		discoverer := func() []string { return []string{router.RegisterURL()} }
+
+		wg := &sync.WaitGroup{}
+		for j := 0; j < 4; j++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				_ = c.Connect(discoverer, 2)
+			}()
+			go func() {
+				defer wg.Done()
+				c.Shutdown()
+			}()
+		}
+		wg.Wait()
+
+		c.Shutdown()
+		select {
+		case <-c.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("connector not stopped")
+		}
+
+		if c.state != stateStopped {
+			t.Fatalf("expected stopped, got %d", c.state)
+		}
+	}
+}
+
+func TestCanConnectAgainAfterShutdown(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{ServiceName: "lifecycle", ServiceURL: testServer.URL, ShutdownTimeout: 3 * time.Second}
+	router := connectTest(t, c, 2)
+	discoverer := func() []string { return []string{router.RegisterURL()} }
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(router.URL + "/lifecycle/get")
+		expect.Nil(err)
+		expect.Equal(200, resp.StatusCode)
+		resp.Body.Close()
+
+		done := c.Done()
+		c.Shutdown()
+		<-done
+		expect.Equal(true, router.WaitIdle("lifecycle", 5*time.Second, func(n int) bool { return n == 0 }))
+
+		expect.Nil(c.Connect(discoverer, 2))
+		expect.Equal(true, router.WaitIdle("lifecycle", 5*time.Second, func(n int) bool { return n == 2 }))
+
+		select {
+		case <-c.Done():
+			t.Fatal("Done of the new run is closed")
+		default:
+		}
+	}
+
+	c.Shutdown()
+}
+
+func TestConnectShutdownCyclesDoNotLeakGoroutines(t *testing.T) {
+	service := httptest.NewServer(httpbin.New().Handler())
+	router := crankertest.NewRouter()
+	defer service.Close()
+
+	before := connectorGoroutines()
+
+	c := &Connector{ServiceName: "lifecycle", ServiceURL: service.URL, ShutdownTimeout: time.Second}
+	for i := 0; i < 3; i++ {
+		err := c.Connect(func() []string { return []string{router.RegisterURL()} }, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !router.WaitIdle("lifecycle", 5*time.Second, func(n int) bool { return n == 2 }) {
+			t.Fatal("connector didn't register")
+		}
+
+		// a socket is idle in the router just before its ping starts.
+		time.Sleep(100 * time.Millisecond)
+		running := connectorGoroutines()
+		for j := 0; j < 5; j++ {
+			resp, err := http.Post(router.URL+"/lifecycle/post", "text/plain", strings.NewReader("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+
+		// served sockets are replaced, but nothing of theirs is left behind.
+		router.WaitIdle("lifecycle", 5*time.Second, func(n int) bool { return n == 2 })
+		expectNoMoreGoroutinesThan(t, running)
+
+		c.Shutdown()
+	}
+
+	router.Close()
+	expectNoMoreGoroutinesThan(t, before)
+}
+
+func expectNoMoreGoroutinesThan(t *testing.T, n int) {
+	var after int
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		after = connectorGoroutines()
+		if after <= n {
+			return
+		}
+	}
+
+	t.Fatalf("leaked %d goroutines", after-n)
+}
+
+// connectorGoroutines counts the goroutines running connector code, except the tests themselves.
+func connectorGoroutines() int {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+
+	n := 0
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "connector.Test") {
+			continue
+		}
+
+		if strings.Contains(g, "go-cranker-connector/connector.") || strings.Contains(g, "go-cranker-connector/internal/core.") {
+			n++
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,220 @@
+package connector
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JackKCWong/go-cranker-connector/internal/crankertest"
+)
+
+// newBodySizeService answers the size of the request bodies, and counts the requests in calls.
+func newBodySizeService(t *testing.T, calls *int32) string {
+	service := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(calls, 1)
+		n, err := io.Copy(ioutil.Discard, req.Body)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+		}
+		_, _ = rw.Write([]byte(strconv.FormatInt(n, 10)))
+	}))
+	t.Cleanup(service.Close)
+
+	return service.URL
+}
+
+func post(t *testing.T, url string, body io.Reader, header http.Header) (int, string) {
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header != nil {
+		req.Header = header
+	}
+
+	resp, respBody := do(t, req)
+	return resp.StatusCode, respBody
+}
+
+func TestRequestBodyOverContentLengthLimitIsRejectedEarly(t *testing.T) {
+	expect := Expect{t}
+	var calls int32
+	c := &Connector{
+		ServiceName:        "limits",
+		ServiceURL:         newBodySizeService(t, &calls),
+		MaxRequestBodySize: 100,
+	}
+	router := connectTest(t, c, 1)
+
+	status, body := post(t, router.URL+"/limits/", strings.NewReader(strings.Repeat("a", 101)), nil)
+	expect.Equal(http.StatusRequestEntityTooLarge, status)
+	expect.Equal(true, strings.Contains(body, `"title":"Request Entity Too Large"`))
+	expect.Equal(int32(0), atomic.LoadInt32(&calls))
+
+	status, body = post(t, router.URL+"/limits/", strings.NewReader(strings.Repeat("a", 100)), nil)
+	expect.Equal(http.StatusOK, status)
+	expect.Equal("100", body)
+}
+
+func TestStreamedRequestBodyOverLimitIsRejected(t *testing.T) {
+	expect := Expect{t}
+	var calls int32
+	c := &Connector{
+		ServiceName:        "limits",
+		ServiceURL:         newBodySizeService(t, &calls),
+		MaxRequestBodySize: 10000,
+	}
+	router := connectTest(t, c, 1)
+
+	status, _ := post(t, router.URL+"/limits/", streamed(strings.Repeat("a", 100000)), nil)
+	expect.Equal(http.StatusRequestEntityTooLarge, status)
+
+	status, body := post(t, router.URL+"/limits/", streamed(strings.Repeat("a", 10000)), nil)
+	expect.Equal(http.StatusOK, status)
+	expect.Equal("10000", body)
+}
+
+func TestRuleRequestBodyLimit(t *testing.T) {
+	expect := Expect{t}
+	var calls int32
+	c := &Connector{
+		ServiceName:        "limits",
+		ServiceURL:         newBodySizeService(t, &calls),
+		MaxRequestBodySize: 10,
+		Rules:              []Rule{{PathPrefix: "/upload", MaxRequestBodySize: 1000}},
+	}
+	router := connectTest(t, c, 1)
+
+	status, body := post(t, router.URL+"/limits/upload", strings.NewReader(strings.Repeat("a", 1000)), nil)
+	expect.Equal(http.StatusOK, status)
+	expect.Equal("1000", body)
+
+	status, _ = post(t, router.URL+"/limits/other", strings.NewReader(strings.Repeat("a", 11)), nil)
+	expect.Equal(http.StatusRequestEntityTooLarge, status)
+}
+
+func TestRequestHeaderLimits(t *testing.T) {
+	expect := Expect{t}
+	var calls int32
+	c := &Connector{
+		ServiceName:           "limits",
+		ServiceURL:            newBodySizeService(t, &calls),
+		MaxRequestHeaderBytes: 2048,
+		MaxRequestHeaders:     10,
+	}
+	router := connectTest(t, c, 1)
+
+	header := http.Header{}
+	for i := 0; i < 10; i++ {
+		header.Set(fmt.Sprintf("X-Header%d", i), "v")
+	}
+	status, body := post(t, router.URL+"/limits/", nil, header)
+	expect.Equal(http.StatusRequestHeaderFieldsTooLarge, status)
+	expect.Equal(true, strings.Contains(body, `"status":431`))
+
+	status, _ = post(t, router.URL+"/limits/", nil, http.Header{"X-Large": {strings.Repeat("a", 2048)}})
+	expect.Equal(http.StatusRequestHeaderFieldsTooLarge, status)
+	expect.Equal(int32(0), atomic.LoadInt32(&calls))
+
+	status, _ = post(t, router.URL+"/limits/", nil, http.Header{"X-Large": {strings.Repeat("a", 1024)}})
+	expect.Equal(http.StatusOK, status)
+}
+
+func TestHandlerReadingBodyOverLimitGetsErrBodyTooLarge(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{
+		ServiceName:        "limits",
+		MaxRequestBodySize: 10,
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			_, err := ioutil.ReadAll(req.Body)
+			_, _ = rw.Write([]byte(strconv.FormatBool(errors.Is(err, ErrBodyTooLarge))))
+		}),
+	}
+	router := connectTest(t, c, 1)
+
+	status, body := post(t, router.URL+"/limits/", streamed(strings.Repeat("a", 11)), nil)
+	expect.Equal(http.StatusOK, status)
+	expect.Equal("true", body)
+}
+
+// getWithHeadOf sends a request with a head of exactly size bytes from the router, request line and headers.
+func getWithHeadOf(t *testing.T, router *crankertest.Router, size int) int {
+	req, err := http.NewRequest(http.MethodGet, router.URL+"/limits/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Accept-Encoding", "identity")
+	req.Header.Set("User-Agent", "t")
+	head := fmt.Sprintf("GET /limits/ HTTP/1.1\r\nHost: %s\r\nAccept-Encoding: identity\r\nUser-Agent: t\r\nX-Large: \r\n\r\n", req.URL.Host)
+	req.Header.Set("X-Large", strings.Repeat("a", size-len(head)))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+func TestRequestHeadLimitBoundaries(t *testing.T) {
+	expect := Expect{t}
+	var calls int32
+	c := &Connector{
+		ServiceName:           "limits",
+		ServiceURL:            newBodySizeService(t, &calls),
+		MaxRequestHeaderBytes: 64 * 1024,
+	}
+	router := connectTest(t, c, 1)
+
+	// heads larger than the 32 KB read limit of the websocket library by default.
+	expect.Equal(http.StatusOK, getWithHeadOf(t, router, 64*1024))
+	expect.Equal(http.StatusRequestHeaderFieldsTooLarge, getWithHeadOf(t, router, 64*1024+1))
+	expect.Equal(http.StatusRequestHeaderFieldsTooLarge, getWithHeadOf(t, router, 64*1024+4000))
+	expect.Equal(int32(1), atomic.LoadInt32(&calls))
+
+	expect.Equal(true, router.WaitIdle("limits", 5*time.Second, func(n int) bool { return n == 1 }))
+	expect.Equal(http.StatusOK, getWithHeadOf(t, router, 1024))
+}
+
+func TestWebSocketMessageOverLimitClosesTheSocket(t *testing.T) {
+	expect := Expect{t}
+	var calls int32
+	c := &Connector{
+		ServiceName:             "limits",
+		ServiceURL:              newBodySizeService(t, &calls),
+		MaxRequestHeaderBytes:   2048,
+		MaxWebSocketMessageSize: 4096,
+	}
+	router := connectTest(t, c, 1)
+
+	// the head can't be read to send a 431.
+	expect.Equal(http.StatusBadGateway, getWithHeadOf(t, router, 4097))
+	expect.Equal(int32(0), atomic.LoadInt32(&calls))
+
+	// the router sends the body in messages of 8 KB.
+	expect.Equal(true, router.WaitIdle("limits", 5*time.Second, func(n int) bool { return n == 1 }))
+	status, _ := post(t, router.URL+"/limits/", streamed(strings.Repeat("a", 8192)), nil)
+	expect.Equal(http.StatusBadGateway, status)
+
+	expect.Equal(true, router.WaitIdle("limits", 5*time.Second, func(n int) bool { return n == 1 }))
+	status, body := post(t, router.URL+"/limits/", streamed(strings.Repeat("a", 4096)), nil)
+	expect.Equal(http.StatusOK, status)
+	expect.Equal("4096", body)
+}
+
+func TestWebSocketMessageSizeMustFitTheHead(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{ServiceName: "limits", ServiceURL: "http://localhost", MaxRequestHeaderBytes: 4096, MaxWebSocketMessageSize: 4096}
+	err := c.Connect(func() []string { return nil }, 1)
+	expect.Equal("MaxWebSocketMessageSize must be larger than MaxRequestHeaderBytes", err.Error())
+}
@@ -0,0 +1,142 @@
+package connector
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JackKCWong/go-cranker-connector/internal/crankertest"
+)
+
+func TestListenServesAnExistingHttpServer(t *testing.T) {
+	expect := Expect{t}
+	router := crankertest.NewRouter()
+	defer router.Close()
+
+	listener, err := Listen("listen", func() []string { return []string{router.RegisterURL()} }, 2)
+	expect.Nil(err)
+	expect.Equal("listen", listener.Addr().String())
+
+	var closed int32
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			body, _ := ioutil.ReadAll(req.Body)
+			rw.Header().Set("X-Path", req.URL.Path)
+			rw.Header().Set("X-Local-Network", req.Context().Value(http.LocalAddrContextKey).(net.Addr).Network())
+			_, _ = rw.Write([]byte(req.Method + " " + string(body)))
+		}),
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateClosed {
+				atomic.AddInt32(&closed, 1)
+			}
+		},
+	}
+
+	served := make(chan error)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	expect.Equal(true, router.WaitIdle("listen", 5*time.Second, func(n int) bool { return n == 2 }))
+
+	resp, err := http.Post(router.URL+"/listen/echo", "text/plain", strings.NewReader("hello"))
+	expect.Nil(err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	expect.Nil(err)
+	expect.Equal(200, resp.StatusCode)
+	expect.Equal("POST hello", string(body))
+	expect.Equal("/echo", resp.Header.Get("X-Path"))
+	expect.Equal("cranker", resp.Header.Get("X-Local-Network"))
+	expect.Equal("", resp.Header.Get("Connection"))
+
+	expect.Equal("GET ", getBody(t, router.URL+"/listen/get"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	expect.Nil(server.Shutdown(ctx))
+	expect.Equal(http.ErrServerClosed, <-served)
+	expect.Equal(int32(2), atomic.LoadInt32(&closed))
+	expect.Equal(true, router.WaitIdle("listen", 5*time.Second, func(n int) bool { return n == 0 }))
+}
+
+func TestListenerHonoursServerTimeouts(t *testing.T) {
+	expect := Expect{t}
+	router := crankertest.NewRouter()
+	defer router.Close()
+
+	c := &Connector{ServiceName: "listen", ShutdownTimeout: time.Second}
+	listener, err := c.Listen(func() []string { return []string{router.RegisterURL()} }, 1)
+	expect.Nil(err)
+	defer listener.Close()
+
+	server := &http.Server{
+		Handler: http.TimeoutHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			time.Sleep(time.Second)
+		}), 100*time.Millisecond, "too slow"),
+		ReadTimeout: time.Second,
+	}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	defer server.Close()
+	expect.Equal(true, router.WaitIdle("listen", 5*time.Second, func(n int) bool { return n == 1 }))
+
+	resp, err := http.Get(router.URL + "/listen/slow")
+	expect.Nil(err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	expect.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	expect.Equal("too slow", string(body))
+}
+
+func TestAcceptReturnsErrorAfterClose(t *testing.T) {
+	expect := Expect{t}
+	router := crankertest.NewRouter()
+	defer router.Close()
+
+	listener, err := Listen("listen", func() []string { return []string{router.RegisterURL()} }, 1)
+	expect.Nil(err)
+
+	expect.Nil(listener.Close())
+	expect.Nil(listener.Close())
+
+	conn, err := listener.Accept()
+	expect.Nil(conn)
+	expect.Equal(ErrListenerClosed, err)
+}
+
+func TestListenDoesNotTakeOverAConnectedConnector(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{ServiceName: "listen", ServiceURL: testServer.URL}
+	router := connectTest(t, c, 1)
+
+	discoverer := func() []string { return []string{router.RegisterURL()} }
+	_, err := c.Listen(discoverer, 1)
+	expect.Equal(ErrAlreadyConnected, err)
+
+	// connected again, the requests still go to ServiceURL.
+	c.Shutdown()
+	expect.Nil(c.Connect(discoverer, 1))
+	expect.Equal(true, router.WaitIdle("listen", 5*time.Second, func(n int) bool { return n == 1 }))
+	resp, _ := get(t, router.URL+"/listen/get")
+	expect.Equal(http.StatusOK, resp.StatusCode)
+}
+
+func TestConnectAfterTheListenerIsClosedRequiresServiceURL(t *testing.T) {
+	expect := Expect{t}
+	router := crankertest.NewRouter()
+	defer router.Close()
+	discoverer := func() []string { return []string{router.RegisterURL()} }
+
+	c := &Connector{ServiceName: "listen"}
+	listener, err := c.Listen(discoverer, 1)
+	expect.Nil(err)
+	expect.Nil(listener.Close())
+
+	expect.Equal("requires ServiceURL", c.Connect(discoverer, 1).Error())
+}
@@ -0,0 +1,146 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// trace appends name to the X-Trace header of the request, and of the response.
+func trace(name string) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			req.Header.Add("X-Trace", name)
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				return nil, err
+			}
+
+			resp.Header.Add("X-Trace", name)
+			return resp, nil
+		})
+	}
+}
+
+// newTraceService answers the X-Trace header and the path of the requests, which it counts in calls.
+func newTraceService(t *testing.T, calls *int32) string {
+	service := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(calls, 1)
+		_, _ = rw.Write([]byte(strings.Join(req.Header["X-Trace"], ",") + " " + req.URL.Path))
+	}))
+	t.Cleanup(service.Close)
+
+	return service.URL
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	expect := Expect{t}
+	var calls int32
+	c := &Connector{ServiceName: "mw", ServiceURL: newTraceService(t, &calls), Middleware: []Middleware{trace("a"), trace("b")}}
+	router := connectTest(t, c, 1)
+
+	resp, err := http.Get(router.URL + "/mw/path")
+	expect.Nil(err)
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	expect.Nil(err)
+	expect.Equal("a,b /path", string(body))
+	expect.Equal([]string{"b", "a"}, resp.Header["X-Trace"])
+}
+
+func TestMiddlewareCanAnswerWithoutTheService(t *testing.T) {
+	expect := Expect{t}
+	var calls int32
+	deny := func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusForbidden}, nil
+		})
+	}
+	c := &Connector{ServiceName: "mw", ServiceURL: newTraceService(t, &calls), Middleware: []Middleware{trace("a"), deny, trace("b")}}
+	router := connectTest(t, c, 1)
+
+	resp, err := http.Get(router.URL + "/mw/path")
+	expect.Nil(err)
+	defer resp.Body.Close()
+
+	expect.Equal(http.StatusForbidden, resp.StatusCode)
+	expect.Equal([]string{"a"}, resp.Header["X-Trace"])
+	body, err := ioutil.ReadAll(resp.Body)
+	expect.Nil(err)
+	expect.Equal("", string(body))
+	expect.Equal(int32(0), atomic.LoadInt32(&calls))
+}
+
+func TestMiddlewareErrorsAndPanicsFailTheRequest(t *testing.T) {
+	expect := Expect{t}
+	var calls int32
+	fail := func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			switch req.URL.Path {
+			case "/error":
+				return nil, errors.New("denied")
+			case "/panic":
+				panic("boom")
+			case "/nothing":
+				return nil, nil
+			}
+			return next.RoundTrip(req)
+		})
+	}
+	c := &Connector{ServiceName: "mw", ServiceURL: newTraceService(t, &calls), Middleware: []Middleware{trace("a"), fail}}
+	router := connectTest(t, c, 1)
+
+	for _, path := range []string{"/error", "/panic", "/nothing"} {
+		resp, err := http.Get(router.URL + "/mw" + path)
+		expect.Nil(err)
+		_ = resp.Body.Close()
+
+		expect.Equal(http.StatusInternalServerError, resp.StatusCode)
+		expect.Equal(0, len(resp.Header["X-Trace"]))
+	}
+
+	expect.Equal(int32(0), atomic.LoadInt32(&calls))
+	expect.Equal("a /ok", getBody(t, router.URL+"/mw/ok"))
+}
+
+func TestShutdownIsNotBlockedByTheBodyOfAFailedRequest(t *testing.T) {
+	expect := Expect{t}
+	var calls int32
+	fail := func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return nil, errors.New("denied")
+		})
+	}
+	c := &Connector{
+		ServiceName:     "mw",
+		ServiceURL:      newTraceService(t, &calls),
+		Middleware:      []Middleware{fail},
+		ShutdownTimeout: 3 * time.Second,
+	}
+	router := connectTest(t, c, 1)
+
+	status, _ := send(t, http.MethodPost, router.URL+"/mw/path", strings.NewReader("hello"))
+	expect.Equal(http.StatusInternalServerError, status)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	expect.Nil(c.ShutdownContext(ctx))
+}
+
+func TestMiddlewareRequiresServiceURL(t *testing.T) {
+	c := &Connector{
+		ServiceName: "mw",
+		Handler:     echoPath(),
+		Middleware:  []Middleware{trace("a")},
+	}
+
+	err := c.Connect(func() []string { return nil }, 1)
+	Expect{t}.Equal("Middleware requires ServiceURL, wrap the Handler instead", err.Error())
+}
@@ -0,0 +1,162 @@
+package connector
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newShadowService returns a service answering with status, which sends the method, path and body of its requests
+// to received.
+func newShadowService(t *testing.T, status int, release <-chan struct{}) (*httptest.Server, <-chan string) {
+	received := make(chan string, 10)
+	service := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		received <- req.Method + " " + req.URL.Path + " " + string(body)
+		if release != nil {
+			<-release
+		}
+		rw.WriteHeader(status)
+	}))
+	t.Cleanup(service.Close)
+
+	return service, received
+}
+
+// waitMirrored waits for the Mirror of c to count n requests mirrored or failed.
+func waitMirrored(t *testing.T, c *Connector, n uint64) MirrorStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := *c.Status().Mirror
+		if status.Mirrored+status.Failed >= n || time.Now().After(deadline) {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRequestsAreMirroredToTheShadowService(t *testing.T) {
+	expect := Expect{t}
+	shadow, received := newShadowService(t, http.StatusInternalServerError, nil)
+	c := &Connector{
+		ServiceName: "mirror",
+		ServiceURL:  newBodySizeService(t, new(int32)),
+		Mirror:      &Mirror{URL: shadow.URL, Share: 1},
+	}
+	router := connectTest(t, c, 1)
+
+	status, body := send(t, http.MethodPost, router.URL+"/mirror/orders", strings.NewReader("hello"))
+	expect.Equal(http.StatusOK, status)
+	expect.Equal("5", body)
+	expect.Equal("POST /orders hello", <-received)
+
+	status, _ = send(t, http.MethodGet, router.URL+"/mirror/orders", nil)
+	expect.Equal(http.StatusOK, status)
+	expect.Equal("GET /orders ", <-received)
+
+	expect.Equal(MirrorStatus{URL: shadow.URL, Mirrored: 2, Mismatched: 2}, waitMirrored(t, c, 2))
+}
+
+func TestSlowShadowServiceDoesNotDelayTheResponse(t *testing.T) {
+	expect := Expect{t}
+	release := make(chan struct{})
+	shadow, received := newShadowService(t, http.StatusOK, release)
+	c := &Connector{
+		ServiceName: "mirror",
+		ServiceURL:  newBodySizeService(t, new(int32)),
+		Mirror:      &Mirror{URL: shadow.URL, Share: 1, MaxInFlight: 1},
+	}
+	router := connectTest(t, c, 1)
+
+	start := time.Now()
+	status, _ := send(t, http.MethodGet, router.URL+"/mirror/", nil)
+	expect.Equal(http.StatusOK, status)
+	<-received
+
+	// the shadow request in-flight drops the next one.
+	status, _ = send(t, http.MethodGet, router.URL+"/mirror/", nil)
+	expect.Equal(http.StatusOK, status)
+	expect.Equal(true, time.Since(start) < time.Second)
+
+	close(release)
+	expect.Equal(MirrorStatus{URL: shadow.URL, Mirrored: 1, Dropped: 1}, waitMirrored(t, c, 1))
+}
+
+func TestRequestsWithLargeBodiesAreNotMirrored(t *testing.T) {
+	expect := Expect{t}
+	shadow, received := newShadowService(t, http.StatusOK, nil)
+	c := &Connector{
+		ServiceName: "mirror",
+		ServiceURL:  newBodySizeService(t, new(int32)),
+		Mirror:      &Mirror{URL: shadow.URL, Share: 1, MaxBodySize: 1000},
+	}
+	router := connectTest(t, c, 1)
+
+	// with a Content-Length, then streamed.
+	status, body := send(t, http.MethodPut, router.URL+"/mirror/", strings.NewReader(strings.Repeat("a", 1001)))
+	expect.Equal(http.StatusOK, status)
+	expect.Equal("1001", body)
+	status, body = send(t, http.MethodPut, router.URL+"/mirror/", ioutil.NopCloser(strings.NewReader(strings.Repeat("a", 20000))))
+	expect.Equal(http.StatusOK, status)
+	expect.Equal("20000", body)
+
+	status, _ = send(t, http.MethodPut, router.URL+"/mirror/", strings.NewReader("small"))
+	expect.Equal(http.StatusOK, status)
+	expect.Equal("PUT / small", <-received)
+
+	expect.Equal(MirrorStatus{URL: shadow.URL, Mirrored: 1, Dropped: 2}, waitMirrored(t, c, 1))
+}
+
+func TestRequestsAreMirroredBeforeRulesRewriteThem(t *testing.T) {
+	expect := Expect{t}
+	shadow, received := newShadowService(t, http.StatusOK, nil)
+	c := &Connector{
+		ServiceName: "mirror",
+		ServiceURL:  newTraceService(t, new(int32)),
+		Mirror:      &Mirror{URL: shadow.URL, Share: 1},
+		Rules:       []Rule{{Name: "v2", PathPrefix: "/v1/", RewritePath: "/v2/"}},
+	}
+	router := connectTest(t, c, 1)
+
+	status, body := send(t, http.MethodPost, router.URL+"/mirror/v1/orders", strings.NewReader("hello"))
+	expect.Equal(http.StatusOK, status)
+	expect.Equal(" /v2/orders", body)
+	expect.Equal("POST /v1/orders hello", <-received)
+}
+
+func TestInvalidMirror(t *testing.T) {
+	expect := Expect{t}
+	discoverer := func() []string { return nil }
+
+	c := &Connector{ServiceName: "mirror", ServiceURL: "http://localhost", Mirror: &Mirror{URL: "http://shadow", Share: 2}}
+	expect.Equal("invalid Mirror: Share 2 not between 0 and 1", c.Connect(discoverer, 1).Error())
+
+	c = &Connector{ServiceName: "mirror", Handler: http.NotFoundHandler(), Mirror: &Mirror{URL: "http://shadow", Share: 1}}
+	expect.Equal("Mirror requires ServiceURL", c.Connect(discoverer, 1).Error())
+}
+
+func TestShutdownCancelsShadowRequestsInFlight(t *testing.T) {
+	expect := Expect{t}
+	release := make(chan struct{})
+	shadow, received := newShadowService(t, http.StatusOK, release)
+	t.Cleanup(func() { close(release) })
+	c := &Connector{
+		ServiceName: "mirror",
+		ServiceURL:  newBodySizeService(t, new(int32)),
+		Mirror:      &Mirror{URL: shadow.URL, Share: 1, Timeout: time.Minute},
+	}
+	router := connectTest(t, c, 1)
+
+	status, _ := send(t, http.MethodGet, router.URL+"/mirror/", nil)
+	expect.Equal(http.StatusOK, status)
+	<-received
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	expect.Equal(context.DeadlineExceeded, c.ShutdownContext(ctx))
+	expect.Equal(MirrorStatus{URL: shadow.URL, Failed: 1}, *c.Status().Mirror)
+}
@@ -0,0 +1,110 @@
+package connector
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// getWith gets url with the headers in pairs, and returns only the response.
+func getWith(t *testing.T, url string, headers ...string) *http.Response {
+	resp, _ := get(t, url, headers...)
+	return resp
+}
+
+func TestRequestsOverTheRateLimitOfAClientIPAreRejected(t *testing.T) {
+	expect := Expect{t}
+	var calls int32
+	c := &Connector{
+		ServiceName: "ratelimit",
+		ServiceURL:  newBodySizeService(t, &calls),
+		RateLimit:   &RateLimit{Rate: 0.1, Burst: 2},
+	}
+	router := connectTest(t, c, 1)
+
+	for i := 0; i < 2; i++ {
+		resp := getWith(t, router.URL+"/ratelimit/", "X-Forwarded-For", "203.0.113.1")
+		expect.Equal(http.StatusOK, resp.StatusCode)
+	}
+
+	resp := getWith(t, router.URL+"/ratelimit/", "X-Forwarded-For", "203.0.113.1")
+	expect.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	expect.Equal("10", resp.Header.Get("Retry-After"))
+	expect.Equal("application/problem+json", resp.Header.Get("Content-Type"))
+	expect.Equal(int32(2), atomic.LoadInt32(&calls))
+
+	// another client, as told by Forwarded.
+	resp = getWith(t, router.URL+"/ratelimit/", "Forwarded", `for="203.0.113.2:4711"`)
+	expect.Equal(http.StatusOK, resp.StatusCode)
+
+	expect.Equal([]RateLimitStatus{{Name: "ratelimit", Allowed: 3, Limited: 1, Keys: 2}}, c.Status().RateLimits)
+}
+
+func TestRateLimitByHeader(t *testing.T) {
+	expect := Expect{t}
+	var calls int32
+	c := &Connector{
+		ServiceName: "ratelimit",
+		ServiceURL:  newBodySizeService(t, &calls),
+		RateLimit:   &RateLimit{Rate: 0.1, Key: "header:X-Api-Key"},
+	}
+	router := connectTest(t, c, 1)
+
+	expect.Equal(http.StatusOK, getWith(t, router.URL+"/ratelimit/", "X-Api-Key", "a").StatusCode)
+	expect.Equal(http.StatusTooManyRequests, getWith(t, router.URL+"/ratelimit/", "X-Api-Key", "a").StatusCode)
+	expect.Equal(http.StatusOK, getWith(t, router.URL+"/ratelimit/", "X-Api-Key", "b").StatusCode)
+}
+
+func TestRuleRateLimitByRoute(t *testing.T) {
+	expect := Expect{t}
+	var calls int32
+	c := &Connector{
+		ServiceName: "ratelimit",
+		ServiceURL:  newBodySizeService(t, &calls),
+		Rules:       []Rule{{Name: "search", PathPrefix: "/search", RateLimit: &RateLimit{Rate: 0.1, Key: "route"}}},
+	}
+	router := connectTest(t, c, 1)
+
+	expect.Equal(http.StatusOK, getWith(t, router.URL+"/ratelimit/search", "X-Forwarded-For", "203.0.113.1").StatusCode)
+	expect.Equal(http.StatusTooManyRequests, getWith(t, router.URL+"/ratelimit/search", "X-Forwarded-For", "203.0.113.2").StatusCode)
+	for i := 0; i < 3; i++ {
+		expect.Equal(http.StatusOK, getWith(t, router.URL+"/ratelimit/other").StatusCode)
+	}
+
+	expect.Equal([]RateLimitStatus{{Name: "search", Allowed: 1, Limited: 1, Keys: 1}}, c.Status().RateLimits)
+}
+
+func TestShutdownIsNotBlockedByTheBodyOfALimitedRequest(t *testing.T) {
+	expect := Expect{t}
+	var calls int32
+	c := &Connector{
+		ServiceName:     "ratelimit",
+		ServiceURL:      newBodySizeService(t, &calls),
+		RateLimit:       &RateLimit{Rate: 0.1, Burst: 1},
+		ShutdownTimeout: 3 * time.Second,
+	}
+	router := connectTest(t, c, 1)
+
+	status, _ := send(t, http.MethodPost, router.URL+"/ratelimit/", strings.NewReader("hello"))
+	expect.Equal(http.StatusOK, status)
+	status, _ = send(t, http.MethodPost, router.URL+"/ratelimit/", strings.NewReader("hello"))
+	expect.Equal(http.StatusTooManyRequests, status)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	expect.Nil(c.ShutdownContext(ctx))
+}
+
+func TestInvalidRateLimit(t *testing.T) {
+	expect := Expect{t}
+	discoverer := func() []string { return nil }
+
+	c := &Connector{ServiceName: "limits", ServiceURL: "http://localhost", RateLimit: &RateLimit{}}
+	expect.Equal("invalid RateLimit limits: Rate must be positive", c.Connect(discoverer, 1).Error())
+
+	c = &Connector{ServiceName: "limits", ServiceURL: "http://localhost", Rules: []Rule{{RateLimit: &RateLimit{Rate: 1, Key: "user"}}}}
+	expect.Equal(`invalid rule #0: invalid RateLimit #0: unknown Key "user"`, c.Connect(discoverer, 1).Error())
+}
@@ -0,0 +1,122 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JackKCWong/go-cranker-connector/internal/crankertest"
+)
+
+func TestRegistersOnlyWhileServiceIsReady(t *testing.T) {
+	expect := Expect{t}
+	var ready int32
+	service := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/ready" && atomic.LoadInt32(&ready) == 0 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	router := crankertest.NewRouter()
+	defer service.Close()
+	defer router.Close()
+
+	c := &Connector{
+		ServiceName:     "ready",
+		ServiceURL:      service.URL,
+		ShutdownTimeout: time.Second,
+		ReadinessProbe:  &ReadinessProbe{Path: "/ready", Interval: 20 * time.Millisecond, FailureThreshold: 2},
+	}
+	expect.Nil(c.Connect(func() []string { return []string{router.RegisterURL()} }, 2))
+	defer c.Shutdown()
+
+	time.Sleep(100 * time.Millisecond)
+	expect.Equal(0, router.Registered("ready"))
+	expect.Equal(false, c.Status().Ready)
+
+	atomic.StoreInt32(&ready, 1)
+	expect.Equal(true, router.WaitIdle("ready", 5*time.Second, func(n int) bool { return n == 2 }))
+	expect.Equal(true, c.Status().Ready)
+	expect.Equal("ok", getBody(t, router.URL+"/ready/"))
+
+	atomic.StoreInt32(&ready, 0)
+	expect.Equal(true, router.WaitIdle("ready", 5*time.Second, func(n int) bool { return n == 0 }))
+	expect.Equal([]string{c.instanceID}, router.Deregistered())
+	expect.Equal(false, c.Status().Ready)
+	expect.Equal(0, len(c.Status().Crankers))
+
+	// a socket dialed right before the drain may register and close after it
+	time.Sleep(100 * time.Millisecond)
+	expect.Equal(0, router.Idle("ready"))
+	atomic.StoreInt32(&ready, 1)
+	expect.Equal(true, router.WaitIdle("ready", 5*time.Second, func(n int) bool { return n == 2 }))
+	expect.Equal("ok", getBody(t, router.URL+"/ready/"))
+}
+
+func TestUnreadyServiceDrainsInFlightRequests(t *testing.T) {
+	expect := Expect{t}
+	var ready int32 = 1
+	c := &Connector{
+		ServiceName:     "ready",
+		ShutdownTimeout: 3 * time.Second,
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/slow" {
+				atomic.StoreInt32(&ready, 0)
+				time.Sleep(300 * time.Millisecond)
+			}
+			_, _ = rw.Write([]byte("done"))
+		}),
+		ReadinessProbe: &ReadinessProbe{
+			Check: func(ctx context.Context) error {
+				if atomic.LoadInt32(&ready) == 0 {
+					return errors.New("not ready")
+				}
+				return nil
+			},
+			Interval:         20 * time.Millisecond,
+			FailureThreshold: 1,
+		},
+	}
+	router := crankertest.NewRouter()
+	defer router.Close()
+
+	expect.Nil(c.Connect(func() []string { return []string{router.RegisterURL()} }, 1))
+	defer c.Shutdown()
+	expect.Equal(true, router.WaitIdle("ready", 5*time.Second, func(n int) bool { return n == 1 }))
+
+	expect.Equal("done", getBody(t, router.URL+"/ready/slow"))
+	expect.Equal([]string{c.instanceID}, router.Deregistered())
+}
+
+func TestReadinessProbeOfHandler(t *testing.T) {
+	expect := Expect{t}
+	router := crankertest.NewRouter()
+	defer router.Close()
+
+	c := &Connector{
+		ServiceName: "ready",
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/ready" {
+				rw.WriteHeader(http.StatusNoContent)
+			}
+		}),
+		ReadinessProbe: &ReadinessProbe{Path: "/ready"},
+	}
+	expect.Nil(c.Connect(func() []string { return []string{router.RegisterURL()} }, 1))
+	defer c.Shutdown()
+
+	expect.Equal(true, router.WaitIdle("ready", 5*time.Second, func(n int) bool { return n == 1 }))
+}
+
+func TestReadinessProbeRequiresCheckWithListen(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{ServiceName: "ready", ReadinessProbe: &ReadinessProbe{Path: "/ready"}}
+
+	_, err := c.Listen(func() []string { return nil }, 1)
+	expect.Equal("ReadinessProbe requires Check, or Path with a ServiceURL or Handler", err.Error())
+}
@@ -0,0 +1,99 @@
+package connector
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JackKCWong/go-cranker-connector/internal/crankertest"
+)
+
+func TestReconfigureServiceURLWhileRunning(t *testing.T) {
+	expect := Expect{t}
+	v1 := versionedService("v1", 500*time.Millisecond)
+	v2 := versionedService("v2", 0)
+	defer v1.Close()
+	defer v2.Close()
+
+	c := &Connector{ServiceName: "reconf", ServiceURL: v1.URL}
+	router := connectTest(t, c, 2)
+
+	inflight := make(chan string)
+	go func() {
+		inflight <- getBody(t, router.URL+"/reconf/")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	expect.Equal(true, router.WaitIdle("reconf", 5*time.Second, func(n int) bool { return n == 2 }))
+
+	router.ResetLowWater("reconf")
+	cfg := c.Config()
+	cfg.ServiceURL = v2.URL
+	expect.Nil(c.Reconfigure(cfg))
+
+	// old idle sockets are closed only after the new ones are connected
+	time.Sleep(500 * time.Millisecond)
+	expect.Equal(2, router.LowWater("reconf"))
+	expect.Equal(2, router.Idle("reconf"))
+
+	expect.Equal("v2", getBody(t, router.URL+"/reconf/"))
+	expect.Equal("v1", <-inflight)
+}
+
+func TestReconfigureServiceNameAndSlidingWindow(t *testing.T) {
+	expect := Expect{t}
+	service := versionedService("v1", 0)
+	defer service.Close()
+
+	c := &Connector{ServiceName: "old-name", ServiceURL: service.URL}
+	router := connectTest(t, c, 2)
+
+	cfg := c.Config()
+	cfg.ServiceName = "new-name"
+	cfg.SlidingWindow = 3
+	expect.Nil(c.Reconfigure(cfg))
+
+	expect.Equal(true, router.WaitIdle("new-name", 5*time.Second, func(n int) bool { return n == 3 }))
+	expect.Equal(true, router.WaitIdle("old-name", 5*time.Second, func(n int) bool { return n == 0 }))
+	expect.Equal("v1", getBody(t, router.URL+"/new-name/"))
+}
+
+func TestReconfigureRediscoveryInterval(t *testing.T) {
+	expect := Expect{t}
+	service := versionedService("v1", 0)
+	router := crankertest.NewRouter()
+	defer service.Close()
+	defer router.Close()
+
+	var discoveries int32
+	c := &Connector{ServiceName: "reconf", ServiceURL: service.URL}
+	expect.Nil(c.Connect(func() []string {
+		atomic.AddInt32(&discoveries, 1)
+		return []string{router.RegisterURL()}
+	}, 1))
+	defer c.Shutdown()
+
+	time.Sleep(100 * time.Millisecond)
+	expect.Equal(int32(1), atomic.LoadInt32(&discoveries))
+
+	cfg := c.Config()
+	cfg.RediscoveryInterval = 20 * time.Millisecond
+	cfg.ShutdownTimeout = time.Second
+	expect.Nil(c.Reconfigure(cfg))
+
+	time.Sleep(200 * time.Millisecond)
+	expect.Equal(true, atomic.LoadInt32(&discoveries) > 3)
+	expect.Equal(time.Second, c.Config().ShutdownTimeout)
+}
+
+func TestReconfigureRejectsInvalidConfig(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{ServiceName: "reconf", ServiceURL: "http://localhost"}
+
+	cfg := c.Config()
+	expect.Equal("slidingWindow must be greater than 0", c.Reconfigure(cfg).Error())
+
+	cfg.SlidingWindow = 1
+	cfg.ServiceURL = ""
+	expect.Equal("requires ServiceURL", c.Reconfigure(cfg).Error())
+	expect.Equal("http://localhost", c.Config().ServiceURL)
+}
@@ -0,0 +1,73 @@
+package connector
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestExpiredIdleSocketsAreReplacedBeforeClosing(t *testing.T) {
+	expect := Expect{t}
+	service := versionedService("v1", 0)
+	defer service.Close()
+
+	c := &Connector{ServiceName: "recycle", ServiceURL: service.URL, MaxSocketIdleAge: 200 * time.Millisecond}
+	router := connectTest(t, c, 2)
+
+	router.ResetLowWater("recycle")
+	time.Sleep(time.Second)
+
+	// there is briefly one more idle socket while an expired one is being replaced, never one less.
+	expect.Equal(2, router.LowWater("recycle"))
+	expect.Equal(true, router.Registered("recycle") >= 8)
+	expect.Equal("v1", getBody(t, router.URL+"/recycle/"))
+}
+
+func TestSocketsLiveForeverByDefault(t *testing.T) {
+	expect := Expect{t}
+	service := versionedService("v1", 0)
+	defer service.Close()
+
+	c := &Connector{ServiceName: "recycle", ServiceURL: service.URL}
+	router := connectTest(t, c, 2)
+
+	time.Sleep(300 * time.Millisecond)
+	expect.Equal(2, router.Registered("recycle"))
+}
+
+func TestMaxSocketLifetimeWinsWhenShorter(t *testing.T) {
+	expect := Expect{t}
+	service := versionedService("v1", 0)
+	defer service.Close()
+
+	c := &Connector{
+		ServiceName:       "recycle",
+		ServiceURL:        service.URL,
+		MaxSocketIdleAge:  time.Hour,
+		MaxSocketLifetime: 200 * time.Millisecond,
+	}
+	router := connectTest(t, c, 1)
+
+	router.ResetLowWater("recycle")
+	time.Sleep(700 * time.Millisecond)
+
+	expect.Equal(1, router.LowWater("recycle"))
+	expect.Equal(true, router.Registered("recycle") >= 3)
+}
+
+func TestInFlightRequestIsCancelledAtMaxSocketLifetime(t *testing.T) {
+	expect := Expect{t}
+	service := versionedService("v1", 2*time.Second)
+	defer service.Close()
+
+	c := &Connector{ServiceName: "recycle", ServiceURL: service.URL, MaxSocketLifetime: 500 * time.Millisecond}
+	router := connectTest(t, c, 1)
+
+	start := time.Now()
+	resp, err := http.Get(router.URL + "/recycle/")
+	expect.Nil(err)
+	resp.Body.Close()
+
+	expect.Equal(http.StatusBadGateway, resp.StatusCode)
+	expect.Equal(true, time.Since(start) < 1500*time.Millisecond)
+}
@@ -0,0 +1,163 @@
+package connector
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// resettingListener resets the first connections it accepts, like a service restarting.
+type resettingListener struct {
+	net.Listener
+	resets int32
+}
+
+func (l *resettingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || atomic.AddInt32(&l.resets, -1) < 0 {
+			return conn, err
+		}
+
+		_ = conn.(*net.TCPConn).SetLinger(0)
+		_ = conn.Close()
+	}
+}
+
+// echoBody answers the request body, once it's read.
+func echoBody() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		_, _ = rw.Write(body)
+	})
+}
+
+// newResettingService echoes the request bodies, after resetting the first resets connections.
+func newResettingService(t *testing.T, resets int32) *httptest.Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := httptest.NewUnstartedServer(echoBody())
+	service.Listener = &resettingListener{Listener: l, resets: resets}
+	service.Start()
+	t.Cleanup(service.Close)
+
+	return service
+}
+
+func TestIdempotentRequestIsRetriedOnConnectionReset(t *testing.T) {
+	expect := Expect{t}
+	service := newResettingService(t, 2)
+	c := &Connector{
+		ServiceName: "retry",
+		ServiceURL:  service.URL,
+		Retry:       Retry{MaxRetries: 3, Backoff: time.Millisecond},
+	}
+	router := connectTest(t, c, 1)
+
+	status, _ := send(t, http.MethodGet, router.URL+"/retry/", nil)
+	expect.Equal(http.StatusOK, status)
+	expect.Equal(uint64(3), c.Status().Upstreams[0].Requests)
+	expect.Equal(uint64(2), c.Status().Upstreams[0].Retries)
+}
+
+func TestRequestIsNotRetriedByDefault(t *testing.T) {
+	expect := Expect{t}
+	service := newResettingService(t, 1)
+	c := &Connector{
+		ServiceName: "retry",
+		ServiceURL:  service.URL,
+	}
+	router := connectTest(t, c, 1)
+
+	status, _ := send(t, http.MethodGet, router.URL+"/retry/", nil)
+	expect.Equal(http.StatusBadGateway, status)
+	expect.Equal(uint64(0), c.Status().Upstreams[0].Retries)
+}
+
+func TestBufferedBodyIsReplayed(t *testing.T) {
+	expect := Expect{t}
+	service := newResettingService(t, 2)
+	c := &Connector{
+		ServiceName: "retry",
+		ServiceURL:  service.URL,
+		Retry:       Retry{MaxRetries: 3, Backoff: time.Millisecond, ReplayBufferSize: 64 * 1024},
+	}
+	router := connectTest(t, c, 1)
+
+	body := strings.Repeat("a", 20000)
+	status, echoed := send(t, http.MethodPut, router.URL+"/retry/", streamed(body))
+	expect.Equal(http.StatusOK, status)
+	expect.Equal(body, echoed)
+	expect.Equal(uint64(2), c.Status().Upstreams[0].Retries)
+}
+
+func TestRequestIsRetriedWhileTheServiceIsRefusingConnections(t *testing.T) {
+	expect := Expect{t}
+	serviceURL := closedURL(t)
+	c := &Connector{
+		ServiceName: "retry",
+		ServiceURL:  serviceURL,
+		Retry:       Retry{MaxRetries: 10, Backoff: 20 * time.Millisecond},
+	}
+	router := connectTest(t, c, 1)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		l, err := net.Listen("tcp", strings.TrimPrefix(serviceURL, "http://"))
+		if err != nil {
+			return
+		}
+		service := httptest.NewUnstartedServer(echoBody())
+		service.Listener = l
+		service.Start()
+		t.Cleanup(service.Close)
+	}()
+
+	// not idempotent, but nothing was sent while the connection is refused.
+	status, echoed := send(t, http.MethodPost, router.URL+"/retry/", strings.NewReader("hello"))
+	expect.Equal(http.StatusOK, status)
+	expect.Equal("hello", echoed)
+}
+
+func TestRetriesAreBoundedByTheBudget(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{
+		ServiceName: "retry",
+		ServiceURL:  closedURL(t),
+		Retry:       Retry{MaxRetries: 100, Backoff: time.Millisecond, Budget: 0.1},
+	}
+	router := connectTest(t, c, 1)
+
+	status, _ := send(t, http.MethodGet, router.URL+"/retry/", nil)
+	expect.Equal(http.StatusBadGateway, status)
+	// the reserve of 10 retries.
+	expect.Equal(uint64(10), c.Status().Upstreams[0].Retries)
+
+	expect.Equal(true, router.WaitIdle("retry", 5*time.Second, func(n int) bool { return n == 1 }))
+	status, _ = send(t, http.MethodGet, router.URL+"/retry/", nil)
+	expect.Equal(http.StatusBadGateway, status)
+	expect.Equal(uint64(10), c.Status().Upstreams[0].Retries)
+}
+
+func TestRetriesStopAfterTimeout(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{
+		ServiceName: "retry",
+		ServiceURL:  closedURL(t),
+		Retry:       Retry{MaxRetries: 5, Backoff: 10 * time.Second, Timeout: 100 * time.Millisecond},
+	}
+	router := connectTest(t, c, 1)
+
+	start := time.Now()
+	status, _ := send(t, http.MethodGet, router.URL+"/retry/", nil)
+	expect.Equal(http.StatusBadGateway, status)
+	expect.Equal(true, time.Since(start) < 5*time.Second)
+}
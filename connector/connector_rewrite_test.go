@@ -0,0 +1,93 @@
+package connector
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"testing"
+)
+
+var noRedirect = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+func getHeader(t *testing.T, rawURL string, query url.Values) http.Header {
+	resp, err := noRedirect.Get(rawURL + "?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	return resp.Header
+}
+
+func TestRewritePathsOfRedirects(t *testing.T) {
+	expect := Expect{t}
+	router := connectTest(t, &Connector{ServiceName: "rewrite", ServiceURL: testServer.URL, RewritePaths: true}, 1)
+	redirectTo := router.URL + "/rewrite/redirect-to"
+
+	header := getHeader(t, redirectTo, url.Values{"url": {"/get?a=b"}})
+	expect.Equal("/rewrite/get?a=b", header.Get("Location"))
+
+	header = getHeader(t, redirectTo, url.Values{"url": {router.URL + "/get"}})
+	expect.Equal(router.URL+"/rewrite/get", header.Get("Location"))
+
+	header = getHeader(t, redirectTo, url.Values{"url": {"http://example.com/get"}})
+	expect.Equal("http://example.com/get", header.Get("Location"))
+
+	header = getHeader(t, redirectTo, url.Values{"url": {"get"}})
+	expect.Equal("get", header.Get("Location"))
+
+	header = getHeader(t, redirectTo, url.Values{"url": {"/rewrite/get"}})
+	expect.Equal("/rewrite/get", header.Get("Location"))
+
+	resp, err := testClient.Get(redirectTo + "?url=/get")
+	expect.Nil(err)
+	defer resp.Body.Close()
+	expect.Equal(200, resp.StatusCode)
+	expect.Equal("/rewrite/get", resp.Request.URL.Path)
+}
+
+func TestRewritePathsOfCookies(t *testing.T) {
+	expect := Expect{t}
+	router := connectTest(t, &Connector{ServiceName: "rewrite", ServiceURL: testServer.URL, RewritePaths: true}, 1)
+
+	header := getHeader(t, router.URL+"/rewrite/cookies/set", url.Values{"k": {"v"}})
+	expect.Equal("/rewrite/cookies", header.Get("Location"))
+	expect.Equal("k=v; HttpOnly", header.Get("Set-Cookie"))
+
+	header = getHeader(t, router.URL+"/rewrite/response-headers", url.Values{
+		"Set-Cookie":       {"a=b; Path=/; Secure", "c=d; path=/app", "e=f; Path=/rewrite/x"},
+		"Refresh":          {"5; url=/login"},
+		"Content-Location": {"/doc"},
+	})
+	expect.Equal([]string{"a=b; Path=/rewrite; Secure", "c=d; path=/rewrite/app", "e=f; Path=/rewrite/x"}, header["Set-Cookie"])
+	expect.Equal("5; url=/rewrite/login", header.Get("Refresh"))
+	expect.Equal("/rewrite/doc", header.Get("Content-Location"))
+
+	jar, err := cookiejar.New(nil)
+	expect.Nil(err)
+	client := &http.Client{Jar: jar}
+	resp, err := client.Get(router.URL + "/rewrite/cookies/set?k=v")
+	expect.Nil(err)
+	defer resp.Body.Close()
+
+	cookies := map[string]string{}
+	expect.Nil(json.NewDecoder(resp.Body).Decode(&cookies))
+	expect.Equal("v", cookies["k"])
+}
+
+func TestPathsAreNotRewrittenByDefault(t *testing.T) {
+	expect := Expect{t}
+	router := connectTest(t, &Connector{ServiceName: "rewrite", ServiceURL: testServer.URL, RewritePaths: false}, 1)
+
+	header := getHeader(t, router.URL+"/rewrite/response-headers", url.Values{
+		"Location":   {"/get"},
+		"Set-Cookie": {"a=b; Path=/"},
+	})
+	expect.Equal("/get", header.Get("Location"))
+	expect.Equal("a=b; Path=/", header.Get("Set-Cookie"))
+}
@@ -0,0 +1,104 @@
+package connector
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// describer answers its name, the method, path and query of the request, and its X-Rule and X-Secret headers.
+func describer(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(strings.Join([]string{
+			name, req.Method, req.URL.RequestURI(), req.Header.Get("X-Rule"), req.Header.Get("X-Secret"),
+		}, " ")))
+	}))
+}
+
+func describe(t *testing.T, method, url string, header http.Header) string {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.TrimSpace(string(body))
+}
+
+func TestRulesRewriteRequests(t *testing.T) {
+	expect := Expect{t}
+	service, legacy := describer("main"), describer("legacy")
+	defer service.Close()
+	defer legacy.Close()
+
+	c := &Connector{ServiceName: "rules", ServiceURL: service.URL, Rules: []Rule{
+		{Name: "prefix", PathPrefix: "/old/", RewritePath: "/new/"},
+		{Name: "regex", PathRegex: `^/users/(\d+)$`, RewritePath: "/api/users/$1/profile"},
+		{
+			Name:        "post",
+			PathPrefix:  "/submit",
+			Methods:     []string{"post"},
+			SetQuery:    map[string]string{"v": "2"},
+			RemoveQuery: []string{"debug"},
+			SetHeaders:  map[string]string{"X-Rule": "post"},
+		},
+		{Name: "legacy", Headers: map[string]string{"X-Version": "legacy"}, ServiceURLs: []string{legacy.URL}},
+		{Name: "secret", Headers: map[string]string{"X-Secret": ""}, RemoveHeaders: []string{"X-Secret"}},
+		{Name: "shadowed", PathPrefix: "/old/", RewritePath: "/shadowed/"},
+	}}
+	router := connectTest(t, c, 1)
+	url := router.URL + "/rules"
+
+	expect.Equal("main GET /new/a?b=c", describe(t, "GET", url+"/old/a?b=c", nil))
+	expect.Equal("main GET /api/users/42/profile", describe(t, "GET", url+"/users/42", nil))
+	expect.Equal("main GET /users/42/x", describe(t, "GET", url+"/users/42/x", nil))
+	expect.Equal("main POST /submit?a=1&v=2 post", describe(t, "POST", url+"/submit?a=1&debug=true&v=1", nil))
+	expect.Equal("main GET /submit?debug=true", describe(t, "GET", url+"/submit?debug=true", nil))
+	expect.Equal("legacy GET /any", describe(t, "GET", url+"/any", http.Header{"X-Version": {"legacy"}}))
+	expect.Equal("main GET /any", describe(t, "GET", url+"/any", http.Header{"X-Version": {"current"}}))
+	expect.Equal("main GET /any", describe(t, "GET", url+"/any", http.Header{"X-Secret": {"s3cr3t"}}))
+	expect.Equal("legacy GET /any  s3cr3t", describe(t, "GET", url+"/any", http.Header{"X-Secret": {"s3cr3t"}, "X-Version": {"legacy"}}))
+}
+
+func TestLoadRules(t *testing.T) {
+	expect := Expect{t}
+	dir, err := ioutil.TempDir("", "rules")
+	expect.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rules.json")
+	expect.Nil(ioutil.WriteFile(path, []byte(`[
+		{"Name": "v1", "PathPrefix": "/v1/", "RewritePath": "/legacy/api/", "Methods": ["GET"]},
+		{"Name": "bad", "PathRegex": "("}
+	]`), 0600))
+
+	rules, err := LoadRules(path)
+	expect.Nil(err)
+	expect.Equal([]Rule{
+		{Name: "v1", PathPrefix: "/v1/", RewritePath: "/legacy/api/", Methods: []string{"GET"}},
+		{Name: "bad", PathRegex: "("},
+	}, rules)
+
+	c := &Connector{ServiceName: "rules", ServiceURL: "http://localhost", Rules: rules}
+	err = c.Connect(func() []string { return nil }, 1)
+	expect.Equal("invalid rule bad: error parsing regexp: missing closing ): `(`", err.Error())
+
+	expect.Nil(ioutil.WriteFile(path, []byte(`{}`), 0600))
+	_, err = LoadRules(path)
+	expect.Equal(true, strings.HasPrefix(err.Error(), "invalid rules file "+path))
+}
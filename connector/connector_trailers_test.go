@@ -0,0 +1,106 @@
+package connector
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JackKCWong/go-cranker-connector/internal/crankertest"
+)
+
+// checksumHandler echoes the request body, then answers the X-Checksum trailer of the request in the one of the response.
+// X-Announced tells how many request trailers were announced before the body.
+var checksumHandler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("X-Announced", strconv.Itoa(len(req.Trailer)))
+	rw.Header().Set("Trailer", "X-Checksum")
+
+	body, _ := ioutil.ReadAll(req.Body)
+	_, _ = rw.Write(body)
+	rw.Header().Set("X-Checksum", "got "+req.Trailer.Get("X-Checksum"))
+})
+
+func trailersRouter() *crankertest.Router {
+	router := crankertest.NewRouter()
+	router.Trailers = true
+	return router
+}
+
+// postWithTrailer posts a chunked body followed by an X-Checksum trailer, and returns the response read to the end.
+func postWithTrailer(t *testing.T, url string) (*http.Response, string) {
+	req, err := http.NewRequest(http.MethodPost, url, ioutil.NopCloser(strings.NewReader("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Trailer = http.Header{"X-Checksum": {"abc"}}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, string(body)
+}
+
+func TestTrailersAreForwardedBothWays(t *testing.T) {
+	t.Run("service", func(t *testing.T) {
+		expect := Expect{t}
+		service := httptest.NewServer(checksumHandler)
+		t.Cleanup(service.Close)
+		router := connectRouter(t, trailersRouter(), &Connector{ServiceName: "trailers", ServiceURL: service.URL}, 1)
+
+		resp, body := postWithTrailer(t, router.URL+"/trailers/checksum")
+		expect.Equal("hello", body)
+		expect.Equal("1", resp.Header.Get("X-Announced"))
+		expect.Equal("got abc", resp.Trailer.Get("X-Checksum"))
+	})
+
+	t.Run("handler", func(t *testing.T) {
+		expect := Expect{t}
+		router := connectRouter(t, trailersRouter(), &Connector{ServiceName: "trailers", Handler: checksumHandler}, 1)
+
+		resp, body := postWithTrailer(t, router.URL+"/trailers/checksum")
+		expect.Equal("hello", body)
+		expect.Equal("1", resp.Header.Get("X-Announced"))
+		expect.Equal("got abc", resp.Trailer.Get("X-Checksum"))
+	})
+
+	t.Run("listener", func(t *testing.T) {
+		expect := Expect{t}
+		router := trailersRouter()
+		t.Cleanup(router.Close)
+
+		listener, err := Listen("trailers", func() []string { return []string{router.RegisterURL()} }, 1)
+		expect.Nil(err)
+		server := &http.Server{Handler: checksumHandler}
+		go func() { _ = server.Serve(listener) }()
+		t.Cleanup(func() { _ = server.Close() })
+		expect.Equal(true, router.WaitIdle("trailers", 5*time.Second, func(n int) bool { return n == 1 }))
+
+		resp, body := postWithTrailer(t, router.URL+"/trailers/checksum")
+		expect.Equal("hello", body)
+		expect.Equal("1", resp.Header.Get("X-Announced"))
+		expect.Equal("got abc", resp.Trailer.Get("X-Checksum"))
+	})
+}
+
+func TestTrailersAreDroppedBothWaysForARouterNotTakingThem(t *testing.T) {
+	expect := Expect{t}
+	router := connectTest(t, &Connector{ServiceName: "trailers", Handler: checksumHandler}, 1)
+
+	resp, body := postWithTrailer(t, router.URL+"/trailers/checksum")
+	expect.Equal("hello", body)
+	expect.Equal("0", resp.Header.Get("X-Announced"))
+	expect.Equal("", resp.Header.Get("Trailer"))
+	expect.Equal("", resp.Header.Get("X-Checksum"))
+	expect.Equal(0, len(resp.Trailer))
+}
@@ -0,0 +1,105 @@
+package connector
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newUnixService starts handler on a unix socket and returns the socket path.
+func newUnixService(t *testing.T, handler http.Handler) string {
+	dir, err := ioutil.TempDir("", "cranker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(dir, "service.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := httptest.NewUnstartedServer(handler)
+	service.Listener = l
+	service.Start()
+	t.Cleanup(func() {
+		service.Close()
+		_ = os.RemoveAll(dir)
+	})
+
+	return socket
+}
+
+func echoPath() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(req.Host + " " + req.URL.RequestURI()))
+	})
+}
+
+func TestUnixSocketServiceURL(t *testing.T) {
+	expect := Expect{t}
+	socket := newUnixService(t, echoPath())
+	router := connectTest(t, &Connector{ServiceName: "unix", ServiceURL: "unix://" + socket}, 1)
+
+	host := router.URL[len("http://"):]
+	expect.Equal(host+" /hello?q=1", getBody(t, router.URL+"/unix/hello?q=1"))
+}
+
+func TestUnixSocketServiceURLWithBasePath(t *testing.T) {
+	expect := Expect{t}
+	socket := newUnixService(t, echoPath())
+	router := connectTest(t, &Connector{ServiceName: "unix", ServiceURL: "unix://" + socket + ":/api/"}, 1)
+
+	host := router.URL[len("http://"):]
+	expect.Equal(host+" /api/hello%2Fworld?q=1", getBody(t, router.URL+"/unix/hello%2Fworld?q=1"))
+}
+
+func TestUnixSocketKeepsTheSettingsOfServiceHttpClient(t *testing.T) {
+	expect := Expect{t}
+	socket := newUnixService(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Large", strings.Repeat("a", 1024))
+	}))
+	router := connectTest(t, &Connector{
+		ServiceName: "unix",
+		ServiceURL:  "unix:" + socket,
+		ServiceHttpClient: &http.Client{
+			Transport: &http.Transport{MaxResponseHeaderBytes: 512},
+		},
+	}, 1)
+
+	resp, err := http.Get(router.URL + "/unix/large")
+	expect.Nil(err)
+	resp.Body.Close()
+	expect.Equal(http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestHttpServiceURLWithBasePath(t *testing.T) {
+	expect := Expect{t}
+	service := httptest.NewServer(echoPath())
+	defer service.Close()
+	router := connectTest(t, &Connector{ServiceName: "unix", ServiceURL: service.URL + "/api"}, 1)
+
+	host := router.URL[len("http://"):]
+	expect.Equal(host+" /api/hello?q=1", getBody(t, router.URL+"/unix/hello?q=1"))
+}
+
+func TestInvalidUnixSocketServiceURL(t *testing.T) {
+	expect := Expect{t}
+	discoverer := func() []string { return nil }
+
+	c := &Connector{ServiceName: "unix", ServiceURL: "unix://relative.sock"}
+	expect.Equal(`invalid ServiceURL: unix socket path must be absolute: "unix://relative.sock"`, c.Connect(discoverer, 1).Error())
+
+	c = &Connector{
+		ServiceName:       "unix",
+		ServiceURL:        "unix:///tmp/service.sock",
+		ServiceHttpClient: &http.Client{Transport: RoundTripperFunc(http.DefaultTransport.RoundTrip)},
+	}
+	expect.Equal("invalid ServiceURL: a unix socket ServiceURL requires an *http.Transport, got core.RoundTripperFunc",
+		c.Connect(discoverer, 1).Error())
+}
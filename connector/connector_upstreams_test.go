@@ -0,0 +1,166 @@
+package connector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// replica answers its name, and its health as set with healthy.
+type replica struct {
+	*httptest.Server
+	name    string
+	healthy int32
+	failing int32
+	hold    chan struct{}
+	held    chan string
+}
+
+func newReplica(t *testing.T, name string) *replica {
+	r := &replica{name: name, healthy: 1, hold: make(chan struct{}), held: make(chan string, 1)}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/health" && atomic.LoadInt32(&r.healthy) == 0:
+			rw.WriteHeader(http.StatusServiceUnavailable)
+		case req.URL.Path == "/hold":
+			r.held <- r.name
+			<-r.hold
+		case atomic.LoadInt32(&r.failing) == 1:
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+
+		_, _ = rw.Write([]byte(r.name))
+	}))
+	t.Cleanup(r.Close)
+
+	return r
+}
+
+func countBodies(t *testing.T, url string, n int) map[string]int {
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		counts[getBody(t, url)]++
+	}
+
+	return counts
+}
+
+func TestRoundRobinBetweenServiceURLs(t *testing.T) {
+	expect := Expect{t}
+	a, b := newReplica(t, "a"), newReplica(t, "b")
+	router := connectTest(t, &Connector{ServiceName: "replicas", ServiceURLs: []string{a.URL, b.URL}}, 2)
+
+	expect.Equal(map[string]int{"a": 3, "b": 3}, countBodies(t, router.URL+"/replicas/", 6))
+}
+
+func TestRandomBetweenServiceURLs(t *testing.T) {
+	expect := Expect{t}
+	a, b := newReplica(t, "a"), newReplica(t, "b")
+	router := connectTest(t, &Connector{ServiceName: "replicas", ServiceURLs: []string{a.URL, b.URL}, LoadBalancing: Random}, 2)
+
+	counts := countBodies(t, router.URL+"/replicas/", 10)
+	expect.Equal(10, counts["a"]+counts["b"])
+}
+
+func TestLeastInFlightAvoidsBusyServiceURLs(t *testing.T) {
+	expect := Expect{t}
+	a, b := newReplica(t, "a"), newReplica(t, "b")
+	c := &Connector{ServiceName: "replicas", ServiceURLs: []string{a.URL, b.URL}, LoadBalancing: LeastInFlight}
+	router := connectTest(t, c, 2)
+
+	held := make(chan string)
+	go func() {
+		held <- getBody(t, router.URL+"/replicas/hold")
+	}()
+
+	var busy, idle *replica
+	select {
+	case <-a.held:
+		busy, idle = a, b
+	case <-b.held:
+		busy, idle = b, a
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not held")
+	}
+
+	expect.Equal(map[string]int{idle.name: 4}, countBodies(t, router.URL+"/replicas/", 4))
+
+	close(busy.hold)
+	expect.Equal(busy.name, <-held)
+}
+
+func TestUnhealthyServiceURLsAreSkipped(t *testing.T) {
+	expect := Expect{t}
+	a, b := newReplica(t, "a"), newReplica(t, "b")
+	atomic.StoreInt32(&b.healthy, 0)
+	c := &Connector{
+		ServiceName: "replicas",
+		ServiceURLs: []string{a.URL, b.URL},
+		HealthCheck: HealthCheck{Path: "/health", Interval: 50 * time.Millisecond, UnhealthyThreshold: 1},
+	}
+	router := connectTest(t, c, 2)
+
+	time.Sleep(100 * time.Millisecond)
+	expect.Equal(map[string]int{"a": 4}, countBodies(t, router.URL+"/replicas/", 4))
+
+	status := c.Status()
+	expect.Equal("running", status.State)
+	expect.Equal(true, status.Upstreams[0].Healthy)
+	expect.Equal(false, status.Upstreams[1].Healthy)
+	expect.Equal("health check failed: 503 Service Unavailable", status.Upstreams[1].LastError)
+
+	atomic.StoreInt32(&b.healthy, 1)
+	time.Sleep(100 * time.Millisecond)
+	expect.Equal(map[string]int{"a": 2, "b": 2}, countBodies(t, router.URL+"/replicas/", 4))
+}
+
+func TestFailingServiceURLsAreEjected(t *testing.T) {
+	expect := Expect{t}
+	a, b := newReplica(t, "a"), newReplica(t, "b")
+	atomic.StoreInt32(&b.failing, 1)
+	c := &Connector{
+		ServiceName:      "replicas",
+		ServiceURLs:      []string{a.URL, b.URL},
+		OutlierDetection: OutlierDetection{ConsecutiveFailures: 2, EjectionTime: 300 * time.Millisecond},
+	}
+	router := connectTest(t, c, 2)
+
+	expect.Equal(map[string]int{"a": 2, "b": 2}, countBodies(t, router.URL+"/replicas/", 4))
+	expect.Equal(map[string]int{"a": 4}, countBodies(t, router.URL+"/replicas/", 4))
+
+	status := c.Status().Upstreams[1]
+	expect.Equal(b.URL, status.URL)
+	expect.Equal(uint64(2), status.Failures)
+	expect.Equal("500 Internal Server Error", status.LastError)
+	expect.Equal(true, status.EjectedUntil.After(time.Now()))
+
+	atomic.StoreInt32(&b.failing, 0)
+	time.Sleep(300 * time.Millisecond)
+	expect.Equal(map[string]int{"a": 2, "b": 2}, countBodies(t, router.URL+"/replicas/", 4))
+}
+
+func TestAllServiceURLsDownFailsOpen(t *testing.T) {
+	expect := Expect{t}
+	a := newReplica(t, "a")
+	atomic.StoreInt32(&a.healthy, 0)
+	c := &Connector{
+		ServiceName: "replicas",
+		ServiceURLs: []string{a.URL},
+		HealthCheck: HealthCheck{Path: "/health", Interval: 50 * time.Millisecond, UnhealthyThreshold: 1},
+	}
+	router := connectTest(t, c, 2)
+
+	time.Sleep(100 * time.Millisecond)
+	expect.Equal(false, c.Status().Upstreams[0].Healthy)
+	expect.Equal("a", getBody(t, router.URL+"/replicas/"))
+}
+
+func TestUnknownLoadBalancingIsRejected(t *testing.T) {
+	expect := Expect{t}
+	c := &Connector{ServiceName: "replicas", ServiceURLs: []string{"http://localhost"}, LoadBalancing: "fastest"}
+
+	expect.Equal(`unknown LoadBalancing "fastest"`, c.Connect(func() []string { return nil }, 1).Error())
+	expect.Equal("new", c.Status().State)
+}
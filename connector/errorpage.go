@@ -0,0 +1,26 @@
+package connector
+
+import (
+	"github.com/JackKCWong/go-cranker-connector/internal/core"
+)
+
+// ProxyError is a request which couldn't be proxied to the service. It's answered with a 413 or a 431
+// for a request over MaxRequestBodySize or the header limits, a 429 over a RateLimit, a 504 on a timeout,
+// a 503 when the service or the Connector is shutting down, a 502 when the service can't be reached
+// or sends an invalid response, and a 500 when the Connector fails otherwise, e.g. a Middleware panics.
+type ProxyError = core.ProxyError
+
+// ErrorPages customizes the responses to the requests which can't be proxied.
+// By default, they are application/problem+json with the ErrorID logged along with the error, e.g.
+//
+//	{"type":"about:blank","title":"Bad Gateway","status":502,"detail":"...","errorId":"..."}
+type ErrorPages = core.ErrorPages
+
+// Template renders an error page with the *ProxyError, e.g. a text/template or html/template Template.
+type Template = core.Template
+
+// ErrBodyTooLarge is returned when reading a request body larger than MaxRequestBodySize, e.g. by a Handler.
+var ErrBodyTooLarge = core.ErrBodyTooLarge
+
+// RateLimitedError fails the requests over a RateLimit, they are answered with a 429 and a Retry-After.
+type RateLimitedError = core.RateLimitedError
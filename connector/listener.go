@@ -0,0 +1,92 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/JackKCWong/go-cranker-connector/internal/core"
+)
+
+// ErrListenerClosed is returned by Accept once the Listener returned by Listen is closed.
+var ErrListenerClosed = errors.New("cranker listener is closed")
+
+// Listen connects a new Connector for serviceName with the default settings, see Connector.Listen.
+func Listen(serviceName string, crankerDiscoverer Discoverer, slidingWindow int8) (net.Listener, error) {
+	c := &Connector{ServiceName: serviceName}
+
+	return c.Listen(crankerDiscoverer, slidingWindow)
+}
+
+// Listen connects to the crankers and returns a net.Listener whose connections each carry a single HTTP/1.1 request,
+// so that an existing http.Server can be exposed through cranker with server.Serve(listener).
+// The requests ask for the connection to be closed after the response. ServiceURL, Handler and ServiceHttpClient
+// are not used. Closing the Listener shuts the Connector down, waiting up to ShutdownTimeout for in-flight requests,
+// a later Connect serves ServiceURL or Handler again.
+func (c *Connector) Listen(crankerDiscoverer Discoverer, slidingWindow int8) (net.Listener, error) {
+	l := &listener{
+		c:      c,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+
+	c.m.Lock()
+	l.addr = core.Addr{Name: c.ServiceName}
+	c.m.Unlock()
+
+	err := c.start(crankerDiscoverer, slidingWindow, l.offer)
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+type listener struct {
+	c      *Connector
+	addr   net.Addr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+// offer blocks until conn is accepted, the listener is closed or ctx is done.
+func (l *listener) offer(ctx context.Context, conn net.Conn) error {
+	select {
+	case l.conns <- conn:
+		return nil
+	case <-l.closed:
+		return ErrListenerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+
+		// the crankers connected from now on don't offer to the closed listener.
+		l.c.m.Lock()
+		l.c.accept = nil
+		l.c.m.Unlock()
+
+		l.c.Shutdown()
+	})
+
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
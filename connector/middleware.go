@@ -0,0 +1,26 @@
+package connector
+
+import (
+	"github.com/JackKCWong/go-cranker-connector/internal/core"
+)
+
+// Middleware wraps the RoundTripper which proxies requests to the ServiceURL(s), next being the rest of the chain.
+//
+// Middleware are applied in order: the first one sees the request first and the response last.
+// The chain owns the request body until it's read or closed by the innermost RoundTripper.
+// A Middleware can answer by itself without calling next, e.g. to deny a request. It must then close the request body,
+// and if it replaces the response of next, it must close the replaced body.
+// The request URL is relative to the service, without the service name, until the innermost RoundTripper
+// resolves it against the ServiceURL picked for it.
+//
+// An error returned by a Middleware, or by next, fails the request with an error response, see ProxyError.
+// The request body is closed then.
+// A panic fails the request with a 500. To answer with another status, return a response instead of an error.
+// A response without a Proto, Status, Header or Body is completed, e.g. &http.Response{StatusCode: 403} is enough.
+//
+// A Middleware is called to build a chain once per cranker and per Reconfigure,
+// so the state shared between requests, e.g. metrics, belongs outside of it.
+type Middleware = core.Middleware
+
+// RoundTripperFunc is a function as an http.RoundTripper, handy to write a Middleware.
+type RoundTripperFunc = core.RoundTripperFunc
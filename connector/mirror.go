@@ -0,0 +1,21 @@
+package connector
+
+import (
+	"github.com/JackKCWong/go-cranker-connector/internal/core"
+	"net/http"
+)
+
+// Mirror configures the copy of a share of the requests to a shadow service, see Connector.Mirror.
+type Mirror = core.Mirror
+
+// MirrorStatus counts the requests mirrored, and the ones whose shadow status differs from the one of the service.
+type MirrorStatus = core.MirrorStatus
+
+// mirror copies the requests picked by m to its shadow service, once the next RoundTripper returns.
+func mirror(m *core.Mirrorer) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return m.RoundTrip(req, next)
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package connector
+
+import (
+	"github.com/JackKCWong/go-cranker-connector/internal/core"
+	"net/http"
+)
+
+// RateLimit configures a token bucket per client IP, header value or route, see Connector.RateLimit and Rule.RateLimit.
+type RateLimit = core.RateLimit
+
+// RateLimitStatus counts the requests allowed and limited by a RateLimit.
+type RateLimitStatus = core.RateLimitStatus
+
+// rateLimited tells if any of the rules has a RateLimit.
+func (rs rules) rateLimited() bool {
+	for _, r := range rs {
+		if r.rateLimiter != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rateLimits applies the RateLimit of the first matching rule, or else the one of the Connector.
+// The requests over the limit fail with a *RateLimitedError before reaching the next RoundTripper, their body is closed.
+func rateLimits(rs rules, limiter *core.RateLimiter, forwarder *core.Forwarder) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			l := limiter
+			if r := rs.match(req); r != nil && r.rateLimiter != nil {
+				l = r.rateLimiter
+			}
+
+			if l != nil {
+				err := l.Allow(req, forwarder)
+				if err != nil {
+					if req.Body != nil {
+						_ = req.Body.Close()
+					}
+					return nil, err
+				}
+			}
+
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// rateLimits returns the statuses of the RateLimit of the Connector, then of the ones of the rules.
+func (c *Connector) rateLimits() []RateLimitStatus {
+	var statuses []RateLimitStatus
+	if c.rateLimiter != nil {
+		statuses = append(statuses, c.rateLimiter.Status())
+	}
+
+	for _, r := range c.rules {
+		if r.rateLimiter != nil {
+			statuses = append(statuses, r.rateLimiter.Status())
+		}
+	}
+
+	return statuses
+}
@@ -0,0 +1,171 @@
+package connector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/JackKCWong/go-cranker-connector/internal/core"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ReadinessProbe tells if the service is ready. The Connector registers to the crankers only while it is,
+// and deregisters, draining in-flight requests, once it isn't.
+type ReadinessProbe struct {
+	// Path is requested with GET on the service, a 2xx or 3xx response means ready.
+	// With ServiceURLs, the service is ready as long as one of them is.
+	Path string
+	// Check is called instead of requesting Path when it's not nil, a nil error means ready.
+	// It's required with Listen, as there is no service to request Path from.
+	Check func(ctx context.Context) error
+	// Interval between probes, 5s by default.
+	Interval time.Duration
+	// Timeout of a probe, 2s by default.
+	Timeout time.Duration
+	// FailureThreshold is the number of consecutive failed probes for a ready service to become unready, 3 by default.
+	FailureThreshold int
+	// SuccessThreshold is the number of consecutive successful probes for an unready service to become ready, 1 by default.
+	SuccessThreshold int
+}
+
+// watchReadiness probes the service until sigDrain is done. The service is unready until the first probes pass.
+func (c *Connector) watchReadiness(sigDrain context.Context, wg *sync.WaitGroup, probe ReadinessProbe) {
+	defer wg.Done()
+
+	if probe.Interval == 0 {
+		probe.Interval = 5 * time.Second
+	}
+
+	if probe.Timeout == 0 {
+		probe.Timeout = 2 * time.Second
+	}
+
+	if probe.FailureThreshold == 0 {
+		probe.FailureThreshold = 3
+	}
+
+	if probe.SuccessThreshold == 0 {
+		probe.SuccessThreshold = 1
+	}
+
+	ready, successes, failures := false, 0, 0
+	for {
+		err := c.probe(sigDrain, probe)
+		if sigDrain.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			successes, failures = successes+1, 0
+			if !ready && successes >= probe.SuccessThreshold {
+				ready = true
+				c.setReady(sigDrain, wg, nil)
+			}
+		} else {
+			successes, failures = 0, failures+1
+			if ready && failures >= probe.FailureThreshold {
+				ready = false
+				c.setReady(sigDrain, wg, err)
+			}
+		}
+
+		select {
+		case <-sigDrain.Done():
+			return
+		case <-time.After(probe.Interval):
+		}
+	}
+}
+
+func (c *Connector) probe(ctx context.Context, probe ReadinessProbe) error {
+	ctx, cancel := context.WithTimeout(ctx, probe.Timeout)
+	defer cancel()
+
+	if probe.Check != nil {
+		return probe.Check(ctx)
+	}
+
+	c.m.Lock()
+	upstreams, handler := c.upstreams, c.Handler
+	c.m.Unlock()
+
+	if upstreams != nil {
+		return upstreams.Probe(ctx, probe.Path)
+	}
+
+	if handler != nil {
+		return probeHandler(ctx, handler, probe.Path)
+	}
+
+	return errors.New("ReadinessProbe requires Check")
+}
+
+// setReady connects to the crankers once the service is ready, err is nil then.
+// Otherwise it deregisters from all of them, which are connected again on the next discovery after the service is ready.
+func (c *Connector) setReady(sigDrain context.Context, wg *sync.WaitGroup, err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if sigDrain.Err() != nil {
+		return
+	}
+
+	c.ready = err == nil
+	if c.ready {
+		c.log.Info().Msg("service is ready, registering")
+		c.triggerDiscovery()
+		return
+	}
+
+	c.log.Warn().Err(err).Msg("service isn't ready, deregistering")
+	crankers := c.crankers
+	crankers.Range(func(url, wss interface{}) bool {
+		crankers.Delete(url)
+		c.retire(wg, wss.(*core.WSSConnector))
+		return true
+	})
+}
+
+// probeHandler requests path from an in-process handler.
+func probeHandler(ctx context.Context, handler http.Handler, path string) error {
+	req, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+
+	rw := &probeResponseWriter{header: http.Header{}}
+	handler.ServeHTTP(rw, req.WithContext(ctx))
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	if rw.status >= 400 {
+		return fmt.Errorf("readiness probe failed: %d %s", rw.status, http.StatusText(rw.status))
+	}
+
+	return nil
+}
+
+type probeResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (rw *probeResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *probeResponseWriter) WriteHeader(statusCode int) {
+	if rw.status == 0 {
+		rw.status = statusCode
+	}
+}
+
+func (rw *probeResponseWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,233 @@
+package connector
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/JackKCWong/go-cranker-connector/internal/core"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Rule rewrites the requests it matches, and optionally sends them to other ServiceURLs.
+// Paths are the ones under the service, without the /ServiceName stripped by the connector.
+// A Rule with no matcher matches every request.
+type Rule struct {
+	// Name identifies the rule in errors and logs.
+	Name string
+	// PathPrefix matches paths starting with it.
+	PathPrefix string
+	// PathRegex matches paths matching it.
+	PathRegex string
+	// Methods match any of these methods, case-insensitively.
+	Methods []string
+	// Headers match requests with all of these headers. An empty value only requires the header to be present.
+	Headers map[string]string
+
+	// RewritePath replaces the part of the path matched by PathRegex, which can be referred to as $1, ${name}, etc.
+	// Without PathRegex, it replaces the PathPrefix, or else the whole path.
+	RewritePath string
+	// SetQuery sets query parameters, after RemoveQuery removes some.
+	SetQuery    map[string]string
+	RemoveQuery []string
+	// SetHeaders sets request headers, after RemoveHeaders removes some.
+	SetHeaders    map[string]string
+	RemoveHeaders []string
+	// MaxRequestBodySize is the maximum body size of the matched requests instead of the one of the Connector.
+	MaxRequestBodySize int64
+	// RateLimit limits the rate of the matched requests instead of the one of the Connector.
+	RateLimit *RateLimit
+	// ServiceURLs are where the matched requests are sent instead of the ServiceURL(s) of the Connector.
+	// They share its LoadBalancing, HealthCheck, OutlierDetection and Retry.
+	ServiceURLs []string
+}
+
+// LoadRules reads rules from a json file, a list of objects with the fields of Rule, e.g.
+//
+//	[{"Name": "legacy", "PathPrefix": "/v1/", "RewritePath": "/legacy/api/", "ServiceURLs": ["http://legacy:8080"]}]
+func LoadRules(path string) ([]Rule, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []Rule
+	err = json.Unmarshal(content, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rules file %s: %w", path, err)
+	}
+
+	return rules, nil
+}
+
+type compiledRule struct {
+	Rule
+	pathRegex   *regexp.Regexp
+	upstreams   *core.Upstreams
+	rateLimiter *core.RateLimiter
+}
+
+// rules are applied in order, only the first matching rule applies to a request.
+type rules []*compiledRule
+
+func compileRules(rs []Rule, cfg Config, client *http.Client) (rules, error) {
+	compiled := make(rules, 0, len(rs))
+	for i, r := range rs {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+
+		cr := &compiledRule{Rule: r}
+		if r.PathRegex != "" {
+			var err error
+			cr.pathRegex, err = regexp.Compile(r.PathRegex)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule %s: %w", name, err)
+			}
+		}
+
+		if r.RateLimit != nil {
+			limit := *r.RateLimit
+			if limit.Name == "" {
+				limit.Name = name
+			}
+
+			var err error
+			cr.rateLimiter, err = core.NewRateLimiter(limit)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule %s: %w", name, err)
+			}
+		}
+
+		if len(r.ServiceURLs) > 0 {
+			cfg.ServiceURLs = r.ServiceURLs
+			upstreams, err := newUpstreams(cfg, client)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule %s: %w", name, err)
+			}
+			cr.upstreams = upstreams
+		}
+
+		compiled = append(compiled, cr)
+	}
+
+	return compiled, nil
+}
+
+// upstreams are the upstreams of the rules with ServiceURLs.
+func (rs rules) upstreams() []*core.Upstreams {
+	var upstreams []*core.Upstreams
+	for _, r := range rs {
+		if r.upstreams != nil {
+			upstreams = append(upstreams, r.upstreams)
+		}
+	}
+
+	return upstreams
+}
+
+// match returns the first matching rule, or nil.
+func (rs rules) match(req *http.Request) *compiledRule {
+	for _, r := range rs {
+		if r.matches(req) {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// middleware applies the first matching rule to the request, before it's sent to the ServiceURL(s).
+func (rs rules) middleware() Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if r := rs.match(req); r != nil {
+				r.apply(req)
+				if r.upstreams != nil {
+					return r.upstreams.RoundTrip(req)
+				}
+			}
+
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+func (r *compiledRule) matches(req *http.Request) bool {
+	if r.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+		return false
+	}
+
+	if r.pathRegex != nil && !r.pathRegex.MatchString(req.URL.Path) {
+		return false
+	}
+
+	if len(r.Methods) > 0 {
+		matched := false
+		for _, m := range r.Methods {
+			matched = matched || strings.EqualFold(m, req.Method)
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	for k, v := range r.Headers {
+		values, ok := req.Header[http.CanonicalHeaderKey(k)]
+		if !ok {
+			return false
+		}
+
+		if v != "" && !contains(values, v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *compiledRule) apply(req *http.Request) {
+	if r.RewritePath != "" {
+		switch {
+		case r.pathRegex != nil:
+			req.URL.Path = r.pathRegex.ReplaceAllString(req.URL.Path, r.RewritePath)
+		case r.PathPrefix != "":
+			req.URL.Path = r.RewritePath + strings.TrimPrefix(req.URL.Path, r.PathPrefix)
+		default:
+			req.URL.Path = r.RewritePath
+		}
+		// the escaping of the original path doesn't apply to the new one.
+		req.URL.RawPath = ""
+	}
+
+	if len(r.SetQuery) > 0 || len(r.RemoveQuery) > 0 {
+		query := req.URL.Query()
+		for _, k := range r.RemoveQuery {
+			query.Del(k)
+		}
+		for k, v := range r.SetQuery {
+			query.Set(k, v)
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+
+	for _, k := range r.RemoveHeaders {
+		req.Header.Del(k)
+	}
+	for k, v := range r.SetHeaders {
+		req.Header.Set(k, v)
+	}
+}
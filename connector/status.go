@@ -0,0 +1,110 @@
+package connector
+
+import (
+	"github.com/JackKCWong/go-cranker-connector/internal/core"
+	"sort"
+)
+
+// LoadBalancing is how one of ServiceURLs is picked for a request.
+type LoadBalancing = core.LoadBalancing
+
+const (
+	// RoundRobin picks the upstreams in turn, it's the default.
+	RoundRobin = core.RoundRobin
+	// LeastInFlight picks the upstream with the fewest requests in-flight.
+	LeastInFlight = core.LeastInFlight
+	// Random picks any upstream.
+	Random = core.Random
+)
+
+// HealthCheck configures the active health checks of ServiceURLs.
+type HealthCheck = core.HealthCheck
+
+// OutlierDetection configures the passive ejection of ServiceURLs failing requests.
+type OutlierDetection = core.OutlierDetection
+
+// Retry configures the retries of the requests failing to reach one of ServiceURLs.
+type Retry = core.Retry
+
+// Forwarding configures the forwarding headers of the requests given to the service. Hop-by-hop headers are always
+// stripped, and the hop of the router is added to Forwarded and X-Forwarded-For, along with X-Forwarded-Proto,
+// X-Forwarded-Host and X-Forwarded-Prefix, the /ServiceName stripped from the path, unless a trusted router sent them.
+type Forwarding = core.Forwarding
+
+// UpstreamStatus is the status of one of ServiceURLs.
+type UpstreamStatus = core.UpstreamStatus
+
+// Status is a snapshot of a Connector, e.g. for a status page.
+type Status struct {
+	ServiceName string
+	// State is one of new, running, draining or stopped.
+	State string
+	// Ready is false while the ReadinessProbe fails, the Connector isn't registered then.
+	Ready bool
+	// Crankers are the register urls of the crankers connected to.
+	Crankers  []string
+	Upstreams []UpstreamStatus
+	// RateLimits are the statuses of the RateLimit of the Connector, then of the ones of the Rules.
+	RateLimits []RateLimitStatus
+	// Versions count the requests sent to the stable version, then to the canary version of Canary, nil without one.
+	Versions []VersionStatus
+	// Mirror counts the requests copied to the shadow service of Mirror, nil without one.
+	Mirror *MirrorStatus
+}
+
+func (s state) String() string {
+	switch s {
+	case stateRunning:
+		return "running"
+	case stateDraining:
+		return "draining"
+	case stateStopped:
+		return "stopped"
+	default:
+		return "new"
+	}
+}
+
+// Status returns a snapshot of the Connector. Upstreams are empty when requests are served in-process,
+// the ones of the Rules follow the ServiceURL(s), then the ones of the Canary.
+func (c *Connector) Status() Status {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	status := Status{
+		ServiceName: c.ServiceName,
+		State:       c.state.String(),
+		Ready:       c.ready,
+	}
+
+	if c.crankers != nil {
+		c.crankers.Range(func(url, _ interface{}) bool {
+			status.Crankers = append(status.Crankers, url.(string))
+			return true
+		})
+		sort.Strings(status.Crankers)
+	}
+
+	if c.upstreams != nil {
+		status.Upstreams = c.upstreams.Status()
+	}
+
+	for _, upstreams := range c.rules.upstreams() {
+		status.Upstreams = append(status.Upstreams, upstreams.Status()...)
+	}
+
+	if c.split != nil {
+		if canaryUpstreams := c.split.Upstreams(); canaryUpstreams != nil {
+			status.Upstreams = append(status.Upstreams, canaryUpstreams.Status()...)
+		}
+		status.Versions = c.split.Status()
+	}
+
+	status.RateLimits = c.rateLimits()
+	if c.mirrorer != nil {
+		mirrored := c.mirrorer.Status()
+		status.Mirror = &mirrored
+	}
+
+	return status
+}
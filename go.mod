@@ -1,13 +1,22 @@
 module github.com/JackKCWong/go-cranker-connector
 
-go 1.14
+go 1.18
 
 require (
 	github.com/google/uuid v1.2.0
 	github.com/mccutchen/go-httpbin/v2 v2.2.0
 	github.com/rs/zerolog v1.20.0
 	github.com/stretchr/testify v1.7.0
+	golang.org/x/net v0.23.0
 	golang.org/x/sync v0.0.0-20190423024810-112230192c58
-	golang.org/x/sys v0.0.0-20200223170610-d5e6a3e2c0ae // indirect
+	golang.org/x/sys v0.18.0 // indirect
 	nhooyr.io/websocket v1.8.6
 )
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/klauspost/compress v1.10.3 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
+)
@@ -0,0 +1,235 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Canary splits the requests between the ServiceURL(s) of the stable version and the ServiceURLs of a canary version.
+type Canary struct {
+	// ServiceURLs of the canary version, which share the LoadBalancing, HealthCheck, OutlierDetection and Retry
+	// of the stable version.
+	ServiceURLs []string
+	// Weight is the percentage of the requests sent to the canary version, from 0 to 100.
+	Weight int
+	// Sticky keeps a client on one version: "cookie:<name>" by a cookie set on its first response,
+	// or "header:<name>", e.g. header:X-User-Id, by a hash of the header value, falling back to a random pick
+	// without the header. Each request is split at random by default.
+	Sticky string
+	// Version and StableVersion name the versions in the statuses and the sticky cookie,
+	// "canary" and "stable" by default.
+	Version       string
+	StableVersion string
+}
+
+// Validate checks the weight and stickiness of c.
+func (c *Canary) Validate() error {
+	if c == nil {
+		return nil
+	}
+
+	if len(c.ServiceURLs) == 0 {
+		return errors.New("invalid Canary: requires ServiceURLs")
+	}
+
+	if c.Weight < 0 || c.Weight > 100 {
+		return fmt.Errorf("invalid Canary: Weight %d not between 0 and 100", c.Weight)
+	}
+
+	_, _, err := c.sticky()
+	if err != nil {
+		return err
+	}
+
+	if c.Version != "" && c.Version == c.StableVersion {
+		return fmt.Errorf("invalid Canary: Version and StableVersion are both %q", c.Version)
+	}
+
+	return nil
+}
+
+// sticky returns the cookie or header name of Sticky.
+func (c *Canary) sticky() (cookie string, header string, err error) {
+	switch {
+	case c.Sticky == "":
+	case strings.HasPrefix(c.Sticky, "cookie:") && len(c.Sticky) > len("cookie:"):
+		cookie = strings.TrimPrefix(c.Sticky, "cookie:")
+	case strings.HasPrefix(c.Sticky, "header:") && len(c.Sticky) > len("header:"):
+		header = http.CanonicalHeaderKey(strings.TrimPrefix(c.Sticky, "header:"))
+	default:
+		return "", "", fmt.Errorf("invalid Canary: unknown Sticky %q", c.Sticky)
+	}
+
+	return cookie, header, nil
+}
+
+// VersionStatus counts the requests sent to a version of the service.
+type VersionStatus struct {
+	Version string
+	// Weight is the percentage of the requests sent to the version.
+	Weight int
+	// Requests sent to the version, Failures among them failed to get a response or got a 5xx.
+	Requests uint64
+	Failures uint64
+}
+
+// split is the Canary in use, and the canary upstreams.
+type split struct {
+	Canary
+	cookie    string
+	header    string
+	upstreams *Upstreams
+}
+
+// CanarySplit sends a share of the requests to a canary version. Its Canary can be changed while it's in use.
+type CanarySplit struct {
+	m      sync.RWMutex
+	split  *split
+	counts map[string]*VersionStatus
+}
+
+// NewCanarySplit returns a CanarySplit without a canary, sending every request to the stable version.
+func NewCanarySplit() *CanarySplit {
+	return &CanarySplit{counts: map[string]*VersionStatus{}}
+}
+
+// Update sends Weight percent of the requests to upstreams from now on, or none when c is nil.
+// The counts of the versions are kept as long as they keep their names. c must be valid.
+func (s *CanarySplit) Update(c *Canary, upstreams *Upstreams) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if c == nil {
+		s.split = nil
+		return
+	}
+
+	sp := &split{Canary: *c, upstreams: upstreams}
+	sp.cookie, sp.header, _ = c.sticky()
+	if sp.Version == "" {
+		sp.Version = "canary"
+	}
+	if sp.StableVersion == "" {
+		sp.StableVersion = "stable"
+	}
+
+	s.split = sp
+	for _, version := range []string{sp.Version, sp.StableVersion} {
+		if s.counts[version] == nil {
+			s.counts[version] = &VersionStatus{Version: version}
+		}
+	}
+}
+
+// SetWeight changes the Weight of the Canary in use, if any. weight must be valid.
+func (s *CanarySplit) SetWeight(weight int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.split != nil {
+		sp := *s.split
+		sp.Weight = weight
+		s.split = &sp
+	}
+}
+
+// Upstreams returns the upstreams of the canary version, nil without one.
+func (s *CanarySplit) Upstreams() *Upstreams {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	if s.split == nil {
+		return nil
+	}
+
+	return s.split.upstreams
+}
+
+// RoundTrip sends req to the canary upstreams, or to next for the stable version.
+func (s *CanarySplit) RoundTrip(req *http.Request, next http.RoundTripper) (*http.Response, error) {
+	s.m.RLock()
+	sp := s.split
+	s.m.RUnlock()
+
+	if sp == nil {
+		return next.RoundTrip(req)
+	}
+
+	canary, assigned := sp.pick(req)
+	version := sp.StableVersion
+	if canary {
+		version = sp.Version
+		next = sp.upstreams
+	}
+
+	s.m.RLock()
+	counts := s.counts[version]
+	s.m.RUnlock()
+
+	resp, err := next.RoundTrip(req)
+	atomic.AddUint64(&counts.Requests, 1)
+	if err != nil || resp.StatusCode >= 500 {
+		atomic.AddUint64(&counts.Failures, 1)
+	}
+
+	if err == nil && !assigned && sp.cookie != "" {
+		resp.Header.Add("Set-Cookie", (&http.Cookie{Name: sp.cookie, Value: version, Path: "/", HttpOnly: true}).String())
+	}
+
+	return resp, err
+}
+
+// pick tells if req goes to the canary version, and if it was already assigned to it by its sticky cookie.
+func (sp *split) pick(req *http.Request) (canary bool, assigned bool) {
+	if sp.cookie != "" {
+		if cookie, err := req.Cookie(sp.cookie); err == nil {
+			switch {
+			case cookie.Value == sp.Version && sp.Weight > 0:
+				return true, true
+			case cookie.Value == sp.StableVersion && sp.Weight < 100:
+				return false, true
+			}
+		}
+	}
+
+	if value := req.Header.Get(sp.header); sp.header != "" && value != "" {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(value))
+		return int(h.Sum32()%100) < sp.Weight, true
+	}
+
+	return rand.Intn(100) < sp.Weight, false
+}
+
+// Status returns the counts of the stable version, then of the canary one, or nil without a canary.
+func (s *CanarySplit) Status() []VersionStatus {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	if s.split == nil {
+		return nil
+	}
+
+	return []VersionStatus{
+		s.count(s.split.StableVersion, 100-s.split.Weight),
+		s.count(s.split.Version, s.split.Weight),
+	}
+}
+
+// count returns the counts of version. s.m must be held.
+func (s *CanarySplit) count(version string, weight int) VersionStatus {
+	counts := s.counts[version]
+
+	return VersionStatus{
+		Version:  version,
+		Weight:   weight,
+		Requests: atomic.LoadUint64(&counts.Requests),
+		Failures: atomic.LoadUint64(&counts.Failures),
+	}
+}
@@ -0,0 +1,225 @@
+package core
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"nhooyr.io/websocket"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Compression configures the gzip compression of the responses, for the clients accepting it.
+type Compression struct {
+	// ContentTypes are the media types compressed, a type ending with / matching all of its subtypes, e.g. text/.
+	// By default, text/, json, javascript and xml types, and image/svg+xml.
+	ContentTypes []string
+	// MinSize is the Content-Length under which a response isn't compressed, 1024 by default.
+	// Responses of an unknown length are always compressed.
+	MinSize int64
+	// Level is the gzip compression level, gzip.DefaultCompression by default.
+	Level int
+}
+
+var defaultCompressedTypes = []string{
+	"text/",
+	"application/json",
+	"application/problem+json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+var gzipWriters = map[int]*sync.Pool{}
+var gzipWritersLock sync.Mutex
+
+// gzipWriterPool returns the pool of the writers of a compression level.
+func gzipWriterPool(level int) *sync.Pool {
+	gzipWritersLock.Lock()
+	defer gzipWritersLock.Unlock()
+
+	pool, ok := gzipWriters[level]
+	if !ok {
+		pool = &sync.Pool{
+			New: func() interface{} {
+				gz, _ := gzip.NewWriterLevel(nil, level)
+				return gz
+			},
+		}
+		gzipWriters[level] = pool
+	}
+
+	return pool
+}
+
+// Validate checks the compression level.
+func (c *Compression) Validate() error {
+	if c != nil && c.Level != gzip.HuffmanOnly && (c.Level < gzip.DefaultCompression || c.Level > gzip.BestCompression) {
+		return fmt.Errorf("invalid Compression.Level %d", c.Level)
+	}
+
+	return nil
+}
+
+// compresses tells if resp is to be compressed, as per the Accept-Encoding of the request it answers.
+func (c *Compression) compresses(resp *http.Response) bool {
+	if c == nil || resp.Request == nil || resp.Request.Method == http.MethodHead {
+		return false
+	}
+
+	switch {
+	case resp.StatusCode < 200, resp.StatusCode == http.StatusNoContent, resp.StatusCode == http.StatusNotModified:
+		return false
+	case resp.Header.Get("Content-Encoding") != "" || resp.Header.Get("Content-Range") != "":
+		// already encoded, or a part of the whole representation.
+		return false
+	case strings.Contains(resp.Header.Get("Cache-Control"), "no-transform"):
+		return false
+	}
+
+	minSize := c.MinSize
+	if minSize == 0 {
+		minSize = 1024
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < minSize {
+		return false
+	}
+
+	return c.compressible(resp.Header.Get("Content-Type")) && acceptsGzip(resp.Request.Header)
+}
+
+func (c *Compression) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	types := c.ContentTypes
+	if len(types) == 0 {
+		types = defaultCompressedTypes
+	}
+
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if mediaType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acceptsGzip tells if the Accept-Encoding header allows gzip, explicitly or with *.
+func acceptsGzip(header http.Header) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, values := range header["Accept-Encoding"] {
+		for _, value := range strings.Split(values, ",") {
+			coding, q := parseCoding(value)
+			switch coding {
+			case "gzip", "x-gzip":
+				gzipQ = q
+			case "*":
+				anyQ = q
+			}
+		}
+	}
+
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+
+	return anyQ > 0
+}
+
+// parseCoding parses a content coding of Accept-Encoding, e.g. gzip;q=0.8. q is 1 when absent, 0 when invalid.
+func parseCoding(value string) (string, float64) {
+	parts := strings.Split(value, ";")
+	coding := strings.ToLower(strings.TrimSpace(parts[0]))
+
+	q := 1.0
+	for _, param := range parts[1:] {
+		param = strings.TrimSpace(param)
+		if strings.HasPrefix(param, "q=") || strings.HasPrefix(param, "Q=") {
+			var err error
+			q, err = strconv.ParseFloat(param[2:], 64)
+			if err != nil {
+				q = 0
+			}
+		}
+	}
+
+	return coding, q
+}
+
+// encode sets the headers of a gzip-encoded resp. Its length isn't known anymore, and a strong ETag becomes weak.
+func encode(resp *http.Response) {
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Add("Vary", "Accept-Encoding")
+
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+}
+
+// frameWriter sends each write as a binary message.
+type frameWriter struct {
+	ctx  context.Context
+	conn *websocket.Conn
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	err := f.conn.Write(f.ctx, websocket.MessageBinary, p)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// gzipFrameWriter compresses into frames, flushing on each write so that streamed responses aren't held back.
+type gzipFrameWriter struct {
+	gz   *gzip.Writer
+	pool *sync.Pool
+}
+
+func newGzipFrameWriter(out io.Writer, level int) *gzipFrameWriter {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+
+	pool := gzipWriterPool(level)
+	gz := pool.Get().(*gzip.Writer)
+	gz.Reset(out)
+
+	return &gzipFrameWriter{gz: gz, pool: pool}
+}
+
+func (g *gzipFrameWriter) Write(p []byte) (int, error) {
+	n, err := g.gz.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, g.gz.Flush()
+}
+
+// Close writes the gzip footer.
+func (g *gzipFrameWriter) Close() error {
+	return g.gz.Close()
+}
+
+// release puts the writer back to the pool, once closed or not.
+func (g *gzipFrameWriter) release() {
+	g.gz.Reset(nil)
+	g.pool.Put(g.gz)
+}
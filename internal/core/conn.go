@@ -0,0 +1,126 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Addr is the address of a connection carried by cranker.
+type Addr struct {
+	// Name is the router url for a remote address, the service name for a local one.
+	Name string
+}
+
+func (a Addr) Network() string {
+	return "cranker"
+}
+
+func (a Addr) String() string {
+	return a.Name
+}
+
+// crankerConn is the server end of a connection carrying a single HTTP/1.1 request from cranker.
+type crankerConn struct {
+	net.Conn
+	local  Addr
+	remote Addr
+}
+
+func (c *crankerConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *crankerConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// serveConn hands req to Accept as a net.Conn, then relays what the server writes back as the response.
+// The request asks for the connection to be closed after the response, as a socket serves a single request.
+// A request whose connection isn't accepted is answered with a 503.
+func (w *WssWorker) serveConn(sigKill context.Context, req *http.Request, buf []byte) error {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	err := w.Accept(sigKill, &crankerConn{
+		Conn:   server,
+		local:  Addr{Name: w.ServiceName},
+		remote: Addr{Name: w.RegisterURL},
+	})
+	if err != nil {
+		_ = server.Close()
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+
+		if sigKill.Err() != nil {
+			return err
+		}
+
+		return w.sendError(sigKill, req, fmt.Errorf("%w: %v", errNotAccepted, err), buf)
+	}
+
+	// closing the connection unblocks the request writer and the response reader once cancelled.
+	done := make(chan struct{})
+	defer close(done)
+	w.bg.Add(1)
+	go func() {
+		defer w.bg.Done()
+
+		select {
+		case <-sigKill.Done():
+			_ = client.Close()
+		case <-done:
+		}
+	}()
+
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+
+	req.Close = true
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// don't let Request.Write add its default
+		req.Header["User-Agent"] = nil
+	}
+
+	w.bg.Add(1)
+	go func() {
+		defer w.bg.Done()
+
+		err := req.Write(client)
+		if err != nil {
+			w.log.Debug().AnErr("err", err).Msg("request not fully written to the connection")
+		}
+	}()
+
+	resp, err := readFinalResponse(bufio.NewReader(client), req)
+	if err != nil {
+		if sigKill.Err() != nil {
+			return sigKill.Err()
+		}
+
+		return fmt.Errorf("ConnResponseError: %w", err)
+	}
+
+	// the connection to the server is hop-by-hop, the one to the router is closed after the response anyway.
+	resp.Header.Del("Connection")
+
+	return w.sendResponse(sigKill, resp, buf)
+}
+
+// readFinalResponse skips informational responses, which cranker can't carry.
+func readFinalResponse(r *bufio.Reader, req *http.Request) (*http.Response, error) {
+	for {
+		resp, err := http.ReadResponse(r, req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ProxyError is a request which couldn't be proxied to the service, it's answered with an error response.
+type ProxyError struct {
+	// StatusCode is 401 or 403 for a request failing authentication,
+	// 413 or 431 for a request over the limits, 429 over a rate limit, 504 on a timeout,
+	// 503 when the service or the connector is shutting down or there is no upstream,
+	// 502 when the service can't be reached or sends an invalid response, and 500 when the connector fails otherwise.
+	StatusCode int
+	// Title is the status text.
+	Title string
+	// Detail explains the status, without the internals of Err.
+	Detail string
+	// ErrorID identifies the error in the logs of the connector.
+	ErrorID string
+	// RetryAfter is when a request over a rate limit may be sent again, it's sent as Retry-After.
+	RetryAfter time.Duration
+	// Challenge is the WWW-Authenticate header of a 401 or 403.
+	Challenge string
+	Err       error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("%d %s (errorId=%s): %v", e.StatusCode, e.Title, e.ErrorID, e.Err)
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// Template renders an error page, e.g. a text/template or html/template Template.
+type Template interface {
+	Execute(wr io.Writer, data interface{}) error
+}
+
+// ErrorPages customizes the error responses. They are application/problem+json by default.
+type ErrorPages struct {
+	// Template renders the body of the error responses with the *ProxyError.
+	Template Template
+	// ContentType of the rendered Template, text/html; charset=utf-8 by default.
+	ContentType string
+	// Render, when not nil, writes the error responses instead, e.g. to render the error pages of an app.
+	// It isn't called for the requests rejected before they are read, with a 431.
+	Render func(rw http.ResponseWriter, req *http.Request, err *ProxyError)
+}
+
+// errNoUpstream is returned when there is no upstream to send a request to.
+var errNoUpstream = errors.New("NoUpstreamError: no upstream")
+
+// errNotAccepted is returned when Accept doesn't take the connection of a request, e.g. the listener is closed.
+var errNotAccepted = errors.New("NotAcceptedError: connection not accepted")
+
+// newProxyError classifies err. shuttingDown tells if the connector is being shut down.
+func newProxyError(err error, errorID string, shuttingDown bool) *ProxyError {
+	var urlErr *url.Error
+	var netErr net.Error
+	var rateErr *RateLimitedError
+	var authErr *AuthError
+
+	e := &ProxyError{ErrorID: errorID, Err: err}
+	switch {
+	case errors.Is(err, ErrBodyTooLarge):
+		e.StatusCode = http.StatusRequestEntityTooLarge
+		e.Detail = "The request body is too large."
+	case errors.Is(err, ErrHeadTooLarge):
+		e.StatusCode = http.StatusRequestHeaderFieldsTooLarge
+		e.Detail = "The request headers are too large."
+	case errors.As(err, &authErr):
+		e.StatusCode = authErr.StatusCode
+		e.Detail = "The request isn't authorized: " + authErr.Description + "."
+		e.Challenge = authErr.challenge()
+	case errors.As(err, &rateErr):
+		e.StatusCode = http.StatusTooManyRequests
+		e.Detail = "Too many requests, retry later."
+		e.RetryAfter = rateErr.RetryAfter
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()):
+		e.StatusCode = http.StatusGatewayTimeout
+		e.Detail = "The service didn't respond in time."
+	case errors.Is(err, errNoUpstream):
+		e.StatusCode = http.StatusServiceUnavailable
+		e.Detail = "There is no service to send the request to."
+	case errors.Is(err, errNotAccepted):
+		e.StatusCode = http.StatusServiceUnavailable
+		e.Detail = "The service isn't accepting requests."
+	case shuttingDown && errors.As(err, &urlErr):
+		e.StatusCode = http.StatusServiceUnavailable
+		e.Detail = "The service is shutting down."
+	case errors.As(err, &urlErr):
+		e.StatusCode = http.StatusBadGateway
+		e.Detail = "The service can't be reached, or sent an invalid response."
+	default:
+		e.StatusCode = http.StatusInternalServerError
+		e.Detail = "The request couldn't be sent to the service."
+	}
+	e.Title = http.StatusText(e.StatusCode)
+
+	return e
+}
+
+// setHeaders sets Retry-After, in seconds rounded up, and WWW-Authenticate as per e.
+func (e *ProxyError) setHeaders(header http.Header) {
+	if e.RetryAfter > 0 {
+		header.Set("Retry-After", strconv.FormatInt(int64(math.Ceil(e.RetryAfter.Seconds())), 10))
+	}
+
+	if e.Challenge != "" {
+		header.Set("WWW-Authenticate", e.Challenge)
+	}
+}
+
+// problem is an RFC 7807 problem details object.
+type problem struct {
+	Type    string `json:"type"`
+	Title   string `json:"title"`
+	Status  int    `json:"status"`
+	Detail  string `json:"detail"`
+	ErrorID string `json:"errorId"`
+}
+
+// response renders e as per pages. A Template failing to render falls back to application/problem+json.
+func (e *ProxyError) response(pages ErrorPages) (*http.Response, error) {
+	body := &bytes.Buffer{}
+	contentType := "application/problem+json"
+
+	var err error
+	if pages.Template != nil {
+		err = pages.Template.Execute(body, e)
+		if err == nil {
+			contentType = pages.ContentType
+			if contentType == "" {
+				contentType = "text/html; charset=utf-8"
+			}
+		} else {
+			body.Reset()
+		}
+	}
+
+	if pages.Template == nil || err != nil {
+		_ = json.NewEncoder(body).Encode(problem{
+			Type:    "about:blank",
+			Title:   e.Title,
+			Status:  e.StatusCode,
+			Detail:  e.Detail,
+			ErrorID: e.ErrorID,
+		})
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.Itoa(body.Len()))
+	e.setHeaders(header)
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.StatusCode, e.Title),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(body),
+		ContentLength: int64(body.Len()),
+	}, err
+}
@@ -0,0 +1,198 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// hopHeaders concern a single connection, they are not forwarded. See RFC 7230, section 6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardedHeaders are set by the proxies in front of the service, they are dropped when sent by an untrusted router.
+var forwardedHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Prefix",
+}
+
+// Forwarding configures the forwarding headers of the requests given to the service.
+type Forwarding struct {
+	// TrustedProxies are the IPs or CIDRs of the routers trusted to forward the Forwarded and X-Forwarded-* headers
+	// of the proxies in front of them. Their headers are preserved and the hop of the router is added to them.
+	// Empty means every router is trusted, as the connector only connects to the routers it discovers.
+	TrustedProxies []string
+	// Overwrite drops the forwarding headers sent by any router, and sets them afresh.
+	Overwrite bool
+	// Proto is the protocol the clients use to reach the routers.
+	// It's https by default with a wss:// router and http otherwise.
+	Proto string
+}
+
+// Forwarder sets the forwarding headers of requests as per its Forwarding.
+type Forwarder struct {
+	Forwarding
+	trusted []*net.IPNet
+}
+
+// NewForwarder returns the Forwarder for f, or an error if one of the TrustedProxies is neither an IP nor a CIDR.
+func NewForwarder(f Forwarding) (*Forwarder, error) {
+	fwd := &Forwarder{Forwarding: f}
+	for _, proxy := range f.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid TrustedProxies: %q", proxy)
+			}
+
+			fwd.trusted = append(fwd.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TrustedProxies: %q", proxy)
+		}
+
+		fwd.trusted = append(fwd.trusted, ipNet)
+	}
+
+	return fwd, nil
+}
+
+func (f *Forwarder) trusts(router net.IP) bool {
+	if f.Overwrite {
+		return false
+	}
+
+	if len(f.trusted) == 0 {
+		return true
+	}
+
+	for _, ipNet := range f.trusted {
+		if router != nil && ipNet.Contains(router) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forward sets the forwarding headers of req, received from the router at req.RemoteAddr.
+// prefix is the path stripped from the request, proto the default protocol of the clients.
+// A nil Forwarder trusts every router.
+func (f *Forwarder) forward(req *http.Request, prefix, proto string) {
+	if f == nil {
+		f = &Forwarder{}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	router := net.ParseIP(host)
+
+	if !f.trusts(router) {
+		for _, h := range forwardedHeaders {
+			req.Header.Del(h)
+		}
+	}
+
+	if f.Proto != "" {
+		proto = f.Proto
+	}
+
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+
+	if req.Header.Get("X-Forwarded-Host") == "" && req.Host != "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+
+	if prefix != "" {
+		req.Header.Set("X-Forwarded-Prefix", strings.TrimSuffix(req.Header.Get("X-Forwarded-Prefix"), "/")+prefix)
+	}
+
+	node := "unknown"
+	if router != nil {
+		appendHeader(req.Header, "X-Forwarded-For", router.String())
+		node = router.String()
+		if router.To4() == nil {
+			node = `"[` + node + `]"`
+		}
+	}
+
+	element := "for=" + node
+	if req.Host != "" {
+		element += ";host=" + quote(req.Host)
+	}
+	appendHeader(req.Header, "Forwarded", element+";proto="+quote(proto))
+}
+
+// appendHeader appends value to the comma separated list of key.
+func appendHeader(h http.Header, key, value string) {
+	if prior := h.Values(key); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+
+	h.Set(key, value)
+}
+
+// quote quotes s unless it's a token, see RFC 7239, section 4
+func quote(s string) string {
+	for _, r := range s {
+		if !isTokenRune(r) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+		}
+	}
+
+	return s
+}
+
+func isTokenRune(r rune) bool {
+	return r < 127 && r > 32 && !strings.ContainsRune(`()<>@,;:\"/[]?={}`, r)
+}
+
+// removeHopHeaders removes the hop-by-hop headers of h, including the ones listed in Connection.
+// keepTE keeps "TE: trailers", which tells the service that trailers are understood, e.g. by gRPC clients.
+func removeHopHeaders(h http.Header, keepTE bool) {
+	trailers := false
+	for _, te := range h["Te"] {
+		for _, v := range strings.Split(te, ",") {
+			if strings.EqualFold(textproto.TrimString(v), "trailers") {
+				trailers = true
+			}
+		}
+	}
+
+	for _, c := range h["Connection"] {
+		for _, name := range strings.Split(c, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+
+	if keepTE && trailers {
+		h.Set("Te", "trailers")
+	}
+}
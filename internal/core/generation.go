@@ -0,0 +1,79 @@
+package core
+
+import (
+	"context"
+	"golang.org/x/sync/semaphore"
+	"net/http"
+	"sync"
+)
+
+// Settings are the settings of a WSSConnector which can be changed while it's running.
+type Settings struct {
+	ServiceName   string
+	ServiceURL    string
+	SlidingWindow int8
+	// Upstreams are where requests are sent, a single upstream for ServiceURL when nil.
+	Upstreams *Upstreams
+}
+
+// generation is a set of sockets sharing the same Settings.
+// A WSSConnector starts a new generation on Reconfigure, and retires the previous one once the new one is ready,
+// so that the router never runs out of idle sockets during the switch.
+type generation struct {
+	Settings
+	sem *semaphore.Weighted
+	// transport sends requests to the Upstreams, through the middleware of the WSSConnector.
+	transport http.RoundTripper
+	// upstreams are the Upstreams of Settings, or the ones made for ServiceURL.
+	upstreams *Upstreams
+	// sigActive is done once a newer generation takes over, no more sockets are dialed for this one.
+	sigActive context.Context
+	supersede context.CancelFunc
+	// sigIdle is done once this generation retires. Its idle sockets are closed, in-flight requests carry on.
+	sigIdle   context.Context
+	idle      context.CancelFunc
+	m         sync.Mutex
+	connected int
+	ready     chan struct{}
+}
+
+func newGeneration(sigDrain context.Context, settings Settings, client *http.Client, middleware []Middleware) *generation {
+	upstreams := settings.Upstreams
+	if upstreams == nil && settings.ServiceURL != "" {
+		// an invalid ServiceURL is rejected by the Connector before it gets here, every request fails otherwise.
+		upstreams, _ = NewUpstreams([]string{settings.ServiceURL}, client)
+	}
+
+	gen := &generation{
+		Settings:  settings,
+		sem:       semaphore.NewWeighted(int64(settings.SlidingWindow)),
+		transport: chain(middleware, upstreams),
+		upstreams: upstreams,
+		ready:     make(chan struct{}),
+	}
+
+	gen.sigIdle, gen.idle = context.WithCancel(sigDrain)
+	gen.sigActive, gen.supersede = context.WithCancel(gen.sigIdle)
+
+	return gen
+}
+
+// retire closes the idle sockets of the generation, and the idle connections to its upstreams,
+// e.g. the HTTP/2 connections to an h2c ServiceURL which would otherwise stay open after a Reconfigure.
+func (gen *generation) retire() {
+	gen.idle()
+	if gen.upstreams != nil {
+		gen.upstreams.closeIdleConnections()
+	}
+}
+
+// onConnected marks the generation ready once all of its sockets have connected for the first time.
+func (gen *generation) onConnected() {
+	gen.m.Lock()
+	defer gen.m.Unlock()
+
+	gen.connected++
+	if gen.connected == int(gen.SlidingWindow) {
+		close(gen.ready)
+	}
+}
@@ -0,0 +1,497 @@
+package core
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTAuth configures the verification of the bearer JWTs of the requests.
+type JWTAuth struct {
+	// JWKSFile is a JSON Web Key Set file with the keys verifying the tokens. It's read again when a token
+	// refers to an unknown kid after the file changed, so that keys can be rotated.
+	JWKSFile string
+	// Keys are static keys by kid, "" for the tokens without kid: *rsa.PublicKey, *ecdsa.PublicKey,
+	// ed25519.PublicKey, or a []byte secret for HMAC.
+	Keys map[string]interface{}
+	// Issuer is the required iss, when not empty.
+	Issuer string
+	// Audience are the accepted aud, one of which is required when not empty.
+	Audience []string
+	// Scopes are required in the scope claim, space separated, or in the scp claim, a list. A token lacking one is
+	// answered with a 403.
+	Scopes []string
+	// Leeway is the clock skew allowed on exp and nbf.
+	Leeway time.Duration
+	// ClaimHeaders set the claims of the verified tokens as request headers, e.g. {"sub": "X-User-Id"}.
+	// The headers sent by the clients are removed. Lists are comma separated, objects are json.
+	ClaimHeaders map[string]string
+}
+
+// AuthError fails a request without a valid token, with a 401, or without the required scopes, with a 403.
+type AuthError struct {
+	StatusCode int
+	// Code is the error code of the WWW-Authenticate challenge, invalid_token or insufficient_scope,
+	// empty without a token.
+	Code        string
+	Description string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("AuthError: %d %s: %s", e.StatusCode, e.Code, e.Description)
+}
+
+// challenge is the WWW-Authenticate header of e, see RFC 6750, section 3.
+func (e *AuthError) challenge() string {
+	if e.Code == "" {
+		return "Bearer"
+	}
+
+	return fmt.Sprintf(`Bearer error="%s", error_description="%s"`, e.Code, strings.ReplaceAll(e.Description, `"`, `'`))
+}
+
+func invalidToken(format string, a ...interface{}) error {
+	return &AuthError{StatusCode: http.StatusUnauthorized, Code: "invalid_token", Description: fmt.Sprintf(format, a...)}
+}
+
+// Authenticator verifies the bearer JWTs of the requests as per its JWTAuth.
+type Authenticator struct {
+	JWTAuth
+	m        sync.Mutex
+	jwks     map[string]interface{}
+	modTime  time.Time
+	lastLoad time.Time
+}
+
+// NewAuthenticator returns the Authenticator of auth, or an error if it has no valid keys.
+func NewAuthenticator(auth JWTAuth) (*Authenticator, error) {
+	a := &Authenticator{JWTAuth: auth}
+	for kid, key := range auth.Keys {
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey, []byte:
+		default:
+			return nil, fmt.Errorf("invalid JWTAuth key %q: unsupported %T", kid, key)
+		}
+	}
+
+	if auth.JWKSFile != "" {
+		err := a.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(auth.Keys) == 0 && len(a.jwks) == 0 {
+		return nil, errors.New("JWTAuth requires JWKSFile or Keys")
+	}
+
+	return a, nil
+}
+
+// load reads JWKSFile. a.m must be held, or a not shared yet.
+func (a *Authenticator) load() error {
+	info, err := os.Stat(a.JWKSFile)
+	if err != nil {
+		return err
+	}
+
+	content, err := ioutil.ReadFile(a.JWKSFile)
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJWKS(content)
+	if err != nil {
+		return fmt.Errorf("invalid JWKSFile %s: %w", a.JWKSFile, err)
+	}
+
+	a.jwks = keys
+	a.modTime = info.ModTime()
+	a.lastLoad = time.Now()
+
+	return nil
+}
+
+// key returns the key of kid, reading JWKSFile again if it changed since, at most once a second.
+func (a *Authenticator) key(kid string) (interface{}, bool) {
+	if key, ok := a.Keys[kid]; ok {
+		return key, true
+	}
+
+	if a.JWKSFile == "" {
+		return nil, false
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if key, ok := a.jwks[kid]; ok {
+		return key, true
+	}
+
+	if time.Since(a.lastLoad) < time.Second {
+		return nil, false
+	}
+
+	a.lastLoad = time.Now()
+	info, err := os.Stat(a.JWKSFile)
+	if err != nil || info.ModTime().Equal(a.modTime) {
+		return nil, false
+	}
+
+	// a file which became invalid keeps the keys already loaded.
+	_ = a.load()
+	key, ok := a.jwks[kid]
+
+	return key, ok
+}
+
+// Authenticate verifies the bearer token of req, then sets its ClaimHeaders. It returns an *AuthError otherwise.
+func (a *Authenticator) Authenticate(req *http.Request) error {
+	for _, header := range a.ClaimHeaders {
+		req.Header.Del(header)
+	}
+
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) < 7 || !strings.EqualFold(authorization[:7], "bearer ") {
+		return &AuthError{StatusCode: http.StatusUnauthorized, Description: "no bearer token"}
+	}
+
+	claims, err := a.verify(strings.TrimSpace(authorization[7:]))
+	if err != nil {
+		return err
+	}
+
+	err = a.check(claims, time.Now())
+	if err != nil {
+		return err
+	}
+
+	for claim, header := range a.ClaimHeaders {
+		if value, ok := claimValue(claims[claim]); ok {
+			req.Header.Set(header, value)
+		}
+	}
+
+	return nil
+}
+
+// verify checks the signature of token and returns its claims.
+func (a *Authenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalidToken("malformed token")
+	}
+
+	var head struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeSegment(parts[0], &head)
+	if err != nil {
+		return nil, invalidToken("malformed header")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalidToken("malformed signature")
+	}
+
+	key, ok := a.key(head.Kid)
+	if !ok {
+		return nil, invalidToken("unknown key %q", head.Kid)
+	}
+
+	err = verifySignature(head.Alg, key, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return nil, invalidToken("%v", err)
+	}
+
+	var claims map[string]interface{}
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, invalidToken("malformed claims")
+	}
+
+	return claims, nil
+}
+
+// check enforces the expiry, issuer, audience and scopes of claims.
+func (a *Authenticator) check(claims map[string]interface{}, now time.Time) error {
+	exp, ok := numericDate(claims["exp"])
+	if !ok {
+		return invalidToken("no exp")
+	}
+	if !now.Before(exp.Add(a.Leeway)) {
+		return invalidToken("token expired")
+	}
+
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(a.Leeway).Before(nbf) {
+		return invalidToken("token not valid yet")
+	}
+
+	if a.Issuer != "" && claims["iss"] != a.Issuer {
+		return invalidToken("unexpected issuer")
+	}
+
+	if len(a.Audience) > 0 && !intersects(a.Audience, stringList(claims["aud"])) {
+		return invalidToken("unexpected audience")
+	}
+
+	scopes := stringList(claims["scp"])
+	if scope, ok := claims["scope"].(string); ok {
+		scopes = append(scopes, strings.Fields(scope)...)
+	}
+
+	for _, required := range a.Scopes {
+		if !intersects([]string{required}, scopes) {
+			return &AuthError{StatusCode: http.StatusForbidden, Code: "insufficient_scope", Description: "requires scope " + required}
+		}
+	}
+
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	content, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	return decoder.Decode(v)
+}
+
+func numericDate(v interface{}) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	seconds, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, int64(seconds*float64(time.Second))), true
+}
+
+// stringList returns a string, or the strings of a list.
+func stringList(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	default:
+		return nil
+	}
+}
+
+func intersects(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// claimValue formats a claim as a header value.
+func claimValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case []interface{}:
+		if list := stringList(v); len(list) == len(v) {
+			return strings.Join(list, ","), true
+		}
+	}
+
+	content, err := json.Marshal(v)
+
+	return string(content), err == nil
+}
+
+// verifySignature checks signature with key as per alg, which must suit the type of key.
+func verifySignature(alg string, key interface{}, signed, signature []byte) error {
+	var hash crypto.Hash
+	var curveSize int
+	switch {
+	case strings.HasSuffix(alg, "256"):
+		hash, curveSize = crypto.SHA256, 256
+	case strings.HasSuffix(alg, "384"):
+		hash, curveSize = crypto.SHA384, 384
+	case strings.HasSuffix(alg, "512"):
+		hash, curveSize = crypto.SHA512, 521
+	}
+
+	digest := func() []byte {
+		h := hash.New()
+		_, _ = h.Write(signed)
+		return h.Sum(nil)
+	}
+
+	invalid := errors.New("invalid signature")
+	switch {
+	case alg == "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok || !ed25519.Verify(pub, signed, signature) {
+			return invalid
+		}
+	case hash == 0:
+		return fmt.Errorf("unsupported alg %q", alg)
+	case strings.HasPrefix(alg, "HS"):
+		secret, ok := key.([]byte)
+		if !ok {
+			return invalid
+		}
+		mac := hmac.New(hash.New, secret)
+		_, _ = mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return invalid
+		}
+	case strings.HasPrefix(alg, "RS"):
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(pub, hash, digest(), signature) != nil {
+			return invalid
+		}
+	case strings.HasPrefix(alg, "PS"):
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPSS(pub, hash, digest(), signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) != nil {
+			return invalid
+		}
+	case strings.HasPrefix(alg, "ES"):
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Params().BitSize != curveSize {
+			return invalid
+		}
+		size := (curveSize + 7) / 8
+		if len(signature) != 2*size {
+			return invalid
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest(), r, s) {
+			return invalid
+		}
+	default:
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+
+	return nil
+}
+
+// jwk is a JSON Web Key, see RFC 7517 and RFC 7518, section 6.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// parseJWKS returns the signature keys of a JSON Web Key Set by kid.
+func parseJWKS(content []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	err := json.Unmarshal(content, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, errN := b64.DecodeString(k.N)
+		e, errE := b64.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		x, errX := b64.DecodeString(k.X)
+		y, errY := b64.DecodeString(k.Y)
+		if !ok || errX != nil || errY != nil {
+			return nil, errors.New("invalid EC key")
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return pub, nil
+	case "OKP":
+		x, err := b64.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid OKP key")
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		secret, err := b64.DecodeString(k.K)
+		if err != nil || len(secret) == 0 {
+			return nil, errors.New("invalid oct key")
+		}
+		return secret, nil
+	default:
+		return nil, fmt.Errorf("unsupported kty %q", k.Kty)
+	}
+}
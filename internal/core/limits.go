@@ -0,0 +1,98 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ErrBodyTooLarge is returned when reading a request body larger than its limit. The request is answered with a 413.
+var ErrBodyTooLarge = errors.New("BodyTooLargeError: request body too large")
+
+// ErrHeadTooLarge is returned when a request has more headers, or more bytes of headers, than allowed.
+// The request is answered with a 431.
+var ErrHeadTooLarge = errors.New("HeadTooLargeError: request header fields too large")
+
+// limitBody fails a request with a Content-Length over max right away, and a streamed body as soon as it crosses max.
+func limitBody(req *http.Request, max int64) error {
+	if req.ContentLength > max {
+		return fmt.Errorf("%w: Content-Length %d over %d", ErrBodyTooLarge, req.ContentLength, max)
+	}
+
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &limitedBody{ReadCloser: req.Body, remaining: max}
+	}
+
+	return nil
+}
+
+// limitedBody is like http.MaxBytesReader, without a ResponseWriter to tell.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	err       error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.remaining {
+		b.remaining -= int64(n)
+		return n, err
+	}
+
+	// the body crossed the limit, stop reading it: closing the pipe stops the request body pump.
+	n = int(b.remaining)
+	b.remaining = 0
+	b.err = ErrBodyTooLarge
+	_ = b.ReadCloser.Close()
+
+	return n, b.err
+}
+
+// checkHead enforces the limits on the number of header values and on the size of the head, when not zero.
+func checkHead(headSize int64, header http.Header, maxBytes, maxHeaders int) error {
+	if maxBytes > 0 && headSize > int64(maxBytes) {
+		return fmt.Errorf("%w: %d bytes over %d", ErrHeadTooLarge, headSize, maxBytes)
+	}
+
+	if maxHeaders > 0 {
+		count := 0
+		for _, values := range header {
+			count += len(values)
+		}
+
+		if count > maxHeaders {
+			return fmt.Errorf("%w: %d headers over %d", ErrHeadTooLarge, count, maxHeaders)
+		}
+	}
+
+	return nil
+}
+
+// defaultReadLimit is the read limit of the websocket library, when MaxMessageSize is zero.
+const defaultReadLimit = 32768
+
+// readError wraps an error reading from the router after n bytes of the message. A message over the read limit is
+// reported as a protocol error, as the router can't send it, the socket is already closed with 1009 then.
+// The websocket library reads a byte over the limit before failing, so n is only over it then.
+func (w *WssWorker) readError(kind, what string, n int64, err error) error {
+	limit := w.MaxMessageSize
+	if limit <= 0 {
+		limit = defaultReadLimit
+	}
+
+	if n > limit {
+		return fmt.Errorf("CrankerProtoError: %s message over MaxWebSocketMessageSize: %w", what, err)
+	}
+
+	return fmt.Errorf("%s: %w", kind, err)
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// Middleware wraps the RoundTripper which sends requests to the service, next is the rest of the chain.
+type Middleware func(next http.RoundTripper) http.RoundTripper
+
+// RoundTripperFunc is a function as an http.RoundTripper.
+type RoundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// chain wraps rt in middleware, the first one being the outermost.
+// Each middleware is given complete responses by the rest of the chain, see completeResponse.
+func chain(middleware []Middleware, rt http.RoundTripper) http.RoundTripper {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		next := middleware[i](rt)
+		rt = RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return completeResponse(next.RoundTrip(req))
+		})
+	}
+
+	return rt
+}
+
+// roundTrip sends req through transport. A panicking middleware fails the request.
+func (w *WssWorker) roundTrip(transport http.RoundTripper, req *http.Request) (resp *http.Response, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			w.log.Error().
+				Interface("panic", p).
+				Bytes("stack", debug.Stack()).
+				Msg("middleware panicked")
+
+			resp, err = nil, fmt.Errorf("MiddlewarePanic: %v", p)
+		}
+	}()
+
+	return transport.RoundTrip(req)
+}
+
+// completeResponse fails a missing response, and completes a response made up by a middleware
+// with what sendResponse needs.
+func completeResponse(resp *http.Response, err error) (*http.Response, error) {
+	if err != nil {
+		if resp != nil && resp.Body != nil {
+			_ = resp.Body.Close()
+		}
+		return nil, err
+	}
+
+	if resp == nil {
+		return nil, errors.New("MiddlewareError: no response and no error")
+	}
+
+	if resp.Proto == "" {
+		resp.Proto = "HTTP/1.1"
+	}
+
+	if resp.Status == "" {
+		resp.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+
+	if resp.Body == nil {
+		resp.Body = http.NoBody
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,265 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Mirror configures the copy of a share of the requests to a shadow service. The shadow requests are sent once
+// the response of the service is received, their responses are discarded.
+type Mirror struct {
+	// URL of the shadow service, like a ServiceURL.
+	URL string
+	// Share of the requests mirrored, from 0 to 1.
+	Share float64
+	// MaxBodySize of the requests mirrored, 64 KB by default. Their bodies are copied as the service reads them,
+	// the requests with a larger body aren't mirrored.
+	MaxBodySize int64
+	// Timeout of the shadow requests, 10s by default.
+	Timeout time.Duration
+	// MaxInFlight is the number of shadow requests in-flight at most, 100 by default. The others are dropped.
+	MaxInFlight int
+}
+
+// MirrorStatus counts the shadow requests.
+type MirrorStatus struct {
+	URL string
+	// Mirrored requests got a response from the shadow service, Failed ones didn't.
+	Mirrored uint64
+	Failed   uint64
+	// Dropped requests weren't mirrored, with a body over MaxBodySize or over MaxInFlight.
+	Dropped uint64
+	// Mismatched are the mirrored requests with a status different from the one of the service.
+	Mismatched uint64
+}
+
+// Mirrorer mirrors requests as per its Mirror.
+type Mirrorer struct {
+	Mirror
+	shadow   *Upstreams
+	inFlight int64
+	status   MirrorStatus
+	log      zerolog.Logger
+	// wg tracks the shadow requests, which are cancelled when sigKill is done.
+	wg      sync.WaitGroup
+	sigKill context.Context
+	kill    context.CancelFunc
+}
+
+// NewMirrorer returns the Mirrorer of m, which sends the shadow requests with client.
+func NewMirrorer(m Mirror, client *http.Client, log zerolog.Logger) (*Mirrorer, error) {
+	if m.Share < 0 || m.Share > 1 {
+		return nil, fmt.Errorf("invalid Mirror: Share %v not between 0 and 1", m.Share)
+	}
+
+	shadow, err := NewUpstreams([]string{m.URL}, client)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Mirror: %w", err)
+	}
+
+	if m.MaxBodySize == 0 {
+		m.MaxBodySize = 64 * 1024
+	}
+	if m.Timeout == 0 {
+		m.Timeout = 10 * time.Second
+	}
+	if m.MaxInFlight == 0 {
+		m.MaxInFlight = 100
+	}
+
+	sigKill, kill := context.WithCancel(context.Background())
+	return &Mirrorer{
+		Mirror:  m,
+		shadow:  shadow,
+		status:  MirrorStatus{URL: m.URL},
+		log:     log.With().Str("mirrorURL", m.URL).Logger(),
+		sigKill: sigKill,
+		kill:    kill,
+	}, nil
+}
+
+// RoundTrip sends req with next, and mirrors it if it's picked.
+func (m *Mirrorer) RoundTrip(req *http.Request, next http.RoundTripper) (*http.Response, error) {
+	if rand.Float64() >= m.Share {
+		return next.RoundTrip(req)
+	}
+
+	if req.ContentLength > m.MaxBodySize {
+		atomic.AddUint64(&m.status.Dropped, 1)
+		return next.RoundTrip(req)
+	}
+
+	if atomic.AddInt64(&m.inFlight, 1) > int64(m.MaxInFlight) {
+		atomic.AddInt64(&m.inFlight, -1)
+		atomic.AddUint64(&m.status.Dropped, 1)
+		return next.RoundTrip(req)
+	}
+
+	// the copy is taken before the request is changed on its way to the service.
+	shadowReq := req.Clone(context.Background())
+	var tee *teeBody
+	if req.Body != nil && req.Body != http.NoBody {
+		tee = &teeBody{ReadCloser: req.Body, max: m.MaxBodySize, done: make(chan struct{})}
+		req.Body = tee
+	}
+
+	resp, err := next.RoundTrip(req)
+	primary := 0
+	if err == nil {
+		primary = resp.StatusCode
+	}
+
+	m.wg.Add(1)
+	go m.send(shadowReq, tee, primary)
+
+	return resp, err
+}
+
+// send sends the shadow request once its body is copied, fire-and-forget. primary is the status of the service,
+// zero if it failed.
+func (m *Mirrorer) send(req *http.Request, tee *teeBody, primary int) {
+	defer m.wg.Done()
+	defer atomic.AddInt64(&m.inFlight, -1)
+
+	ctx, cancel := context.WithTimeout(m.sigKill, m.Timeout)
+	defer cancel()
+
+	if tee != nil {
+		body, err := tee.wait(ctx)
+		if err != nil {
+			m.log.Debug().AnErr("err", err).Msg("request not mirrored")
+			atomic.AddUint64(&m.status.Dropped, 1)
+			return
+		}
+
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+
+	resp, err := m.shadow.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		m.log.Info().AnErr("err", err).Int("status", primary).Msg("shadow request failed")
+		atomic.AddUint64(&m.status.Failed, 1)
+		return
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	atomic.AddUint64(&m.status.Mirrored, 1)
+	if resp.StatusCode != primary {
+		atomic.AddUint64(&m.status.Mismatched, 1)
+		m.log.Info().
+			Str("method", req.Method).
+			Str("url", req.URL.String()).
+			Int("status", primary).
+			Int("shadowStatus", resp.StatusCode).
+			Msg("shadow status differs")
+	}
+}
+
+// Wait waits for the shadow requests in-flight to finish. It returns ctx.Err() if they are still running when ctx
+// is done. They are not cancelled. It must be called once no more requests are mirrored.
+func (m *Mirrorer) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		m.log.Warn().Int64("inFlight", atomic.LoadInt64(&m.inFlight)).Msg("shadow requests still running")
+		return ctx.Err()
+	}
+}
+
+// Close cancels the shadow requests still in-flight, and waits for them to exit.
+func (m *Mirrorer) Close() {
+	m.kill()
+	m.wg.Wait()
+}
+
+// Status returns the counts of m.
+func (m *Mirrorer) Status() MirrorStatus {
+	return MirrorStatus{
+		URL:        m.URL,
+		Mirrored:   atomic.LoadUint64(&m.status.Mirrored),
+		Failed:     atomic.LoadUint64(&m.status.Failed),
+		Dropped:    atomic.LoadUint64(&m.status.Dropped),
+		Mismatched: atomic.LoadUint64(&m.status.Mismatched),
+	}
+}
+
+var errBodyNotMirrored = errors.New("body over MaxBodySize or not read to the end")
+
+// teeBody copies a request body up to max bytes as it's read.
+type teeBody struct {
+	io.ReadCloser
+	max      int64
+	m        sync.Mutex
+	buf      bytes.Buffer
+	overflow bool
+	once     sync.Once
+	// done is closed once the body is read to the end, or closed.
+	done     chan struct{}
+	complete bool
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+
+	t.m.Lock()
+	if !t.overflow {
+		if int64(t.buf.Len()+n) > t.max {
+			t.overflow = true
+			t.buf = bytes.Buffer{}
+		} else {
+			t.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		t.complete = true
+	}
+	t.m.Unlock()
+
+	if err != nil {
+		t.once.Do(func() { close(t.done) })
+	}
+
+	return n, err
+}
+
+func (t *teeBody) Close() error {
+	t.once.Do(func() { close(t.done) })
+	return t.ReadCloser.Close()
+}
+
+// wait returns the body once read to the end, or an error if it's over max, or not read to the end.
+func (t *teeBody) wait(ctx context.Context) ([]byte, error) {
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.overflow || !t.complete {
+		return nil, errBodyNotMirrored
+	}
+
+	return t.buf.Bytes(), nil
+}
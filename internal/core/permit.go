@@ -0,0 +1,32 @@
+package core
+
+import (
+	"golang.org/x/sync/semaphore"
+	"sync/atomic"
+)
+
+// permit is the slot of the sliding window held by an idle socket.
+// It's released when the socket receives a request, or handed over to the socket replacing it, whichever comes first.
+type permit struct {
+	sem  *semaphore.Weighted
+	held int32
+}
+
+func newPermit(sem *semaphore.Weighted) *permit {
+	return &permit{sem: sem, held: 1}
+}
+
+func (p *permit) release() {
+	if atomic.CompareAndSwapInt32(&p.held, 1, 0) {
+		p.sem.Release(1)
+	}
+}
+
+// handOver returns a new permit for the same slot, or false if the permit is already released.
+func (p *permit) handOver() (*permit, bool) {
+	if atomic.CompareAndSwapInt32(&p.held, 1, 0) {
+		return newPermit(p.sem), true
+	}
+
+	return nil, false
+}
@@ -1,5 +1,145 @@
 package core
 
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+
+	"nhooyr.io/websocket"
+)
+
 const MarkerReqBodyPending = "_1"
 const MarkerReqHasNoBody = "_2"
 const MarkerReqBodyEnded = "_3"
+
+const CrankerProtocolVersion = "1.0"
+const ComponentName = "go-cranker-connector"
+
+// TrailersSubprotocol is the websocket subprotocol offered when registering, for the trailers following a body,
+// see README.md. A router picking it announces the trailers of a request in its Trailer header,
+// and sends their values in a text message in the format of headers, right before MarkerReqBodyEnded.
+// It takes the trailers of a response the same way, in a text message following the body.
+// Routers which don't know it pick no subprotocol, the trailers are dropped then.
+const TrailersSubprotocol = "cranker-trailers"
+
+func crankerHeaders(serviceName string) http.Header {
+	headers := http.Header{}
+	headers.Add("CrankerProtocol", CrankerProtocolVersion)
+	headers.Add("Route", serviceName)
+
+	return headers
+}
+
+// registerURL adds the connector identity to the url so that the router can tell which sockets belong to which connector.
+func registerURL(rawURL, connectorInstanceID string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	if connectorInstanceID != "" {
+		query := u.Query()
+		query.Set("connectorInstanceID", connectorInstanceID)
+		query.Set("componentName", ComponentName)
+		u.RawQuery = query.Encode()
+	}
+
+	return u.String(), nil
+}
+
+// deregisterURL derives the router's deregister endpoint from its register endpoint,
+// e.g. wss://router/register becomes wss://router/deregister/?connectorInstanceID=...
+func deregisterURL(rawRegisterURL, connectorInstanceID, serviceName string) (string, error) {
+	u, err := url.Parse(rawRegisterURL)
+	if err != nil {
+		return "", err
+	}
+
+	base := strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "register")
+	u.Path = base + "deregister/"
+
+	query := url.Values{}
+	query.Set("connectorInstanceID", connectorInstanceID)
+	query.Set("componentName", ComponentName)
+	query.Set("route", serviceName)
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// announcedTrailer returns the trailers announced in the Trailer header of h, without their values.
+func announcedTrailer(h http.Header) http.Header {
+	trailer := http.Header{}
+	for _, announced := range h["Trailer"] {
+		for _, k := range strings.Split(announced, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				trailer[http.CanonicalHeaderKey(k)] = nil
+			}
+		}
+	}
+
+	return trailer
+}
+
+// trailerNames returns the names of trailer, to announce them in a Trailer header.
+func trailerNames(trailer http.Header) string {
+	names := make([]string, 0, len(trailer))
+	for name := range trailer {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
+
+// parseTrailer parses trailers in the format of headers.
+func parseTrailer(b []byte) (http.Header, error) {
+	tp := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(b), strings.NewReader("\r\n"))))
+	trailer, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return http.Header(trailer), nil
+}
+
+// writeTrailer sends the trailers following a response body, see TrailersSubprotocol.
+func writeTrailer(ctx context.Context, conn *websocket.Conn, trailer http.Header) error {
+	trailerBuf := buffers.Get()
+	defer buffers.Release(trailerBuf)
+
+	err := trailer.Write(trailerBuf)
+	if err != nil || trailerBuf.Len() == 0 {
+		return err
+	}
+
+	return conn.Write(ctx, websocket.MessageText, trailerBuf.Bytes())
+}
+
+// trailerReader is a request body which sets the trailers of the request once it's read to the end,
+// as http.Request.Trailer is documented to be filled.
+type trailerReader struct {
+	*io.PipeReader
+	// trailer is the Trailer of the request.
+	trailer http.Header
+	// received is set by the writer of the pipe before closing it, and copied to trailer at EOF.
+	received http.Header
+}
+
+func (r *trailerReader) Read(p []byte) (int, error) {
+	n, err := r.PipeReader.Read(p)
+	if err == io.EOF && r.received != nil {
+		for k, vs := range r.received {
+			r.trailer[k] = vs
+		}
+		r.received = nil
+	}
+
+	return n, err
+}
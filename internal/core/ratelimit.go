@@ -0,0 +1,234 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit configures a token bucket per key: Rate requests per second are allowed, in bursts of up to Burst.
+type RateLimit struct {
+	// Name identifies the limit in the statuses and errors.
+	Name string
+	// Rate is the number of requests per second allowed per key.
+	Rate float64
+	// Burst is the number of requests allowed at once, Rate rounded up by default.
+	Burst int
+	// Key is what the requests are limited by: "ip", the client IP, by default,
+	// "header:<name>", e.g. header:X-Api-Key, falling back to the client IP without the header,
+	// or "route", every request the limit applies to sharing a single bucket.
+	Key string
+}
+
+// RateLimitStatus is a snapshot of a RateLimit.
+type RateLimitStatus struct {
+	Name string
+	// Allowed and Limited count the requests let through and answered with a 429.
+	Allowed uint64
+	Limited uint64
+	// Keys is the number of buckets kept, the full ones are dropped after a while.
+	Keys int
+}
+
+// RateLimitedError is returned for the requests over a RateLimit. The request is answered with a 429.
+type RateLimitedError struct {
+	Limit      string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("RateLimitedError: over the rate limit %s, retry after %s", e.Limit, e.RetryAfter)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter applies a RateLimit.
+type RateLimiter struct {
+	limit     RateLimit
+	header    string
+	m         sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	status    RateLimitStatus
+}
+
+// NewRateLimiter returns the RateLimiter of limit, or an error if it's invalid.
+func NewRateLimiter(limit RateLimit) (*RateLimiter, error) {
+	if limit.Rate <= 0 {
+		return nil, fmt.Errorf("invalid RateLimit %s: Rate must be positive", limit.Name)
+	}
+
+	if limit.Burst <= 0 {
+		limit.Burst = int(math.Ceil(limit.Rate))
+	}
+
+	l := &RateLimiter{limit: limit, buckets: map[string]*bucket{}, status: RateLimitStatus{Name: limit.Name}}
+	switch {
+	case limit.Key == "" || limit.Key == "ip" || limit.Key == "route":
+	case strings.HasPrefix(limit.Key, "header:") && len(limit.Key) > len("header:"):
+		l.header = http.CanonicalHeaderKey(strings.TrimPrefix(limit.Key, "header:"))
+	default:
+		return nil, fmt.Errorf("invalid RateLimit %s: unknown Key %q", limit.Name, limit.Key)
+	}
+
+	return l, nil
+}
+
+// Allow takes a token from the bucket of req, or returns a *RateLimitedError.
+// f tells the client IP from the forwarding headers.
+func (l *RateLimiter) Allow(req *http.Request, f *Forwarder) error {
+	key := ""
+	switch {
+	case l.limit.Key == "route":
+	case l.header != "" && req.Header.Get(l.header) != "":
+		key = "header:" + req.Header.Get(l.header)
+	default:
+		key = "ip:" + f.ClientIP(req)
+	}
+
+	now := time.Now()
+	burst := float64(l.limit.Burst)
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		l.status.Allowed++
+		return nil
+	}
+
+	l.status.Limited++
+	wait := time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+
+	return &RateLimitedError{Limit: l.limit.Name, RetryAfter: wait}
+}
+
+// sweep drops the buckets which are full again, once in a while. l.m must be held.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	refill := time.Duration(float64(l.limit.Burst) / l.limit.Rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Status returns a snapshot of l.
+func (l *RateLimiter) Status() RateLimitStatus {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	status := l.status
+	status.Keys = len(l.buckets)
+
+	return status
+}
+
+// ClientIP returns the IP of the client of req, after its forwarding headers are set: the last hop before the router
+// in X-Forwarded-For, or else Forwarded, which isn't one of the TrustedProxies. It's the router without such hops.
+func (f *Forwarder) ClientIP(req *http.Request) string {
+	router, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		router = req.RemoteAddr
+	}
+
+	for _, hops := range [][]string{forwardedFor(req.Header), forwardedNodes(req.Header)} {
+		if len(hops) > 0 && hops[len(hops)-1] == router {
+			hops = hops[:len(hops)-1]
+		}
+
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(hops[i])
+			if f == nil || ip == nil || !f.trustsProxy(ip) {
+				return hops[i]
+			}
+		}
+
+		if len(hops) > 0 {
+			return hops[0]
+		}
+	}
+
+	return router
+}
+
+// trustsProxy tells if ip is one of the TrustedProxies.
+func (f *Forwarder) trustsProxy(ip net.IP) bool {
+	for _, ipNet := range f.trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardedFor returns the hops of X-Forwarded-For.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, values := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(values, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+
+	return hops
+}
+
+// forwardedNodes returns the IPs of the for= nodes of Forwarded.
+func forwardedNodes(h http.Header) []string {
+	var hops []string
+	for _, values := range h.Values("Forwarded") {
+		for _, element := range strings.Split(values, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+					hops = append(hops, forwardedNode(pair[4:]))
+				}
+			}
+		}
+	}
+
+	return hops
+}
+
+// forwardedNode returns the IP of a node of Forwarded, e.g. "[2001:db8::1]:8080" or 192.0.2.1:80.
+func forwardedNode(node string) string {
+	node = strings.Trim(node, `"`)
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+
+	return node
+}
@@ -0,0 +1,215 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"nhooyr.io/websocket"
+)
+
+// wssResponseWriter is the http.ResponseWriter given to an in-process http.Handler.
+// The response head is sent as a text message when the body is first written or flushed,
+// then every Write is sent straight to the router as a binary message.
+type wssResponseWriter struct {
+	ctx         context.Context
+	conn        *websocket.Conn
+	log         zerolog.Logger
+	header      http.Header
+	status      int
+	headWritten bool
+	err         error
+	// rewriter adds the service prefix back to the redirects and cookie paths, when not nil.
+	rewriter *pathRewriter
+	// routerTrailers tells if the router takes the trailers following the body, see TrailersSubprotocol.
+	routerTrailers bool
+}
+
+var _ http.Flusher = (*wssResponseWriter)(nil)
+var _ http.Hijacker = (*wssResponseWriter)(nil)
+
+func newWssResponseWriter(ctx context.Context, conn *websocket.Conn, log zerolog.Logger) *wssResponseWriter {
+	return &wssResponseWriter{
+		ctx:    ctx,
+		conn:   conn,
+		log:    log,
+		header: http.Header{},
+	}
+}
+
+func (rw *wssResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *wssResponseWriter) WriteHeader(statusCode int) {
+	if statusCode < 100 || statusCode > 999 {
+		panic(fmt.Sprintf("invalid WriteHeader code %v", statusCode))
+	}
+
+	if rw.status != 0 {
+		rw.log.Warn().Int("status", statusCode).Msg("superfluous WriteHeader call")
+		return
+	}
+
+	if statusCode < 200 {
+		// cranker can't carry informational responses.
+		rw.log.Debug().Int("status", statusCode).Msg("dropping informational response")
+		return
+	}
+
+	rw.status = statusCode
+}
+
+func (rw *wssResponseWriter) Write(p []byte) (int, error) {
+	if !rw.headWritten {
+		if rw.header.Get("Content-Type") == "" && rw.header.Get("Transfer-Encoding") == "" && len(p) > 0 {
+			rw.header.Set("Content-Type", http.DetectContentType(p))
+		}
+
+		rw.writeHead()
+	}
+
+	if rw.err != nil {
+		return 0, rw.err
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if !bodyAllowed(rw.status) {
+		return 0, http.ErrBodyNotAllowed
+	}
+
+	rw.err = rw.conn.Write(rw.ctx, websocket.MessageBinary, p)
+	if rw.err != nil {
+		return 0, rw.err
+	}
+
+	return len(p), nil
+}
+
+// Flush sends the response head if it isn't sent yet. The body isn't buffered, so there is nothing else to flush.
+func (rw *wssResponseWriter) Flush() {
+	if !rw.headWritten {
+		rw.writeHead()
+	}
+}
+
+// Hijack is refused, as the connection is a websocket shared with the router.
+func (rw *wssResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, http.ErrNotSupported
+}
+
+func (rw *wssResponseWriter) writeHead() {
+	rw.headWritten = true
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	header := rw.header.Clone()
+	for k := range header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			delete(header, k)
+		}
+	}
+
+	// the values of the trailers are only known once the body is written.
+	announced := announcedTrailer(rw.header)
+	for k := range announced {
+		header.Del(k)
+	}
+
+	// the trailers are announced to a router taking them, the others drop them.
+	header.Del("Trailer")
+	if rw.routerTrailers && len(announced) > 0 {
+		header.Set("Trailer", trailerNames(announced))
+	}
+
+	rw.err = rw.sendHead(header)
+}
+
+func (rw *wssResponseWriter) sendHead(header http.Header) error {
+	rw.rewriter.rewrite(header)
+
+	headerBuf := buffers.Get()
+	defer buffers.Release(headerBuf)
+
+	_, err := fmt.Fprintf(headerBuf, "HTTP/1.1 %d %s\r\n", rw.status, http.StatusText(rw.status))
+	if err != nil {
+		return err
+	}
+
+	err = header.Write(headerBuf)
+	if err != nil {
+		return err
+	}
+
+	rw.log.Debug().Bytes("respHeader", headerBuf.Bytes()).Msg("sending response headers")
+
+	return rw.conn.Write(rw.ctx, websocket.MessageText, headerBuf.Bytes())
+}
+
+// finish is called after the handler returns. If nothing is written yet, the trailers are folded into the head.
+// Otherwise they follow the body if the router takes them, and are dropped if it doesn't.
+func (rw *wssResponseWriter) finish() error {
+	if rw.headWritten {
+		trailers := rw.trailers()
+		if len(trailers) == 0 || rw.err != nil {
+			return rw.err
+		}
+
+		if !rw.routerTrailers {
+			rw.log.Debug().Int("trailers", len(trailers)).Msg("dropping trailers set after the response started")
+			return nil
+		}
+
+		rw.err = writeTrailer(rw.ctx, rw.conn, trailers)
+		return rw.err
+	}
+
+	trailers := rw.trailers()
+	rw.header.Del("Trailer")
+	for k, vs := range trailers {
+		rw.header[k] = vs
+	}
+
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+
+	if bodyAllowed(rw.status) && rw.header.Get("Content-Length") == "" && rw.header.Get("Transfer-Encoding") == "" {
+		rw.header.Set("Content-Length", strconv.Itoa(0))
+	}
+
+	rw.writeHead()
+
+	return rw.err
+}
+
+// trailers are the values of the keys announced in the Trailer header, and those set with http.TrailerPrefix.
+func (rw *wssResponseWriter) trailers() http.Header {
+	trailers := http.Header{}
+	for k := range announcedTrailer(rw.header) {
+		if vs, ok := rw.header[k]; ok {
+			trailers[k] = vs
+		}
+	}
+
+	for k, vs := range rw.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			trailers[http.CanonicalHeaderKey(strings.TrimPrefix(k, http.TrailerPrefix))] = vs
+		}
+	}
+
+	return trailers
+}
+
+func bodyAllowed(status int) bool {
+	return status != http.StatusNoContent && status != http.StatusNotModified && (status < 100 || status > 199)
+}
@@ -0,0 +1,254 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/JackKCWong/go-cranker-connector/internal/util/retry"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Retry configures the retries of the requests failing to reach an upstream, with the connection refused or reset.
+// Idempotent requests are retried, and the other ones as long as their body wasn't read at all,
+// or the connection was refused, which means nothing was sent.
+type Retry struct {
+	// MaxRetries of a request, zero means no retries.
+	MaxRetries int
+	// Budget is the share of the requests which can be retried on top of a reserve of 10 retries, 0.2 by default.
+	// It keeps the retries from piling up on a service which is down.
+	Budget float64
+	// Timeout stops retrying a request once elapsed since it was first sent, 10s by default.
+	Timeout time.Duration
+	// Backoff is the wait before the first retry, doubled for each retry, 50ms by default.
+	Backoff time.Duration
+	// ReplayBufferSize buffers the bodies of idempotent requests up to that many bytes,
+	// so that they can be sent again after they are read. Zero means no buffering.
+	ReplayBufferSize int64
+}
+
+// retryReserve is the number of retries the budget starts with, and the most it can save.
+const retryReserve = 10
+
+// retryBudget allows a retry for every 1/Budget requests.
+type retryBudget struct {
+	m      sync.Mutex
+	tokens float64
+}
+
+func (b *retryBudget) deposit(share float64) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.tokens += share
+	if b.tokens > retryReserve {
+		b.tokens = retryReserve
+	}
+}
+
+func (b *retryBudget) withdraw() bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+func (r Retry) withDefaults() Retry {
+	if r.Budget == 0 {
+		r.Budget = 0.2
+	}
+	if r.Timeout == 0 {
+		r.Timeout = 10 * time.Second
+	}
+	if r.Backoff == 0 {
+		r.Backoff = 50 * time.Millisecond
+	}
+
+	return r
+}
+
+// isIdempotent tells if sending req again has the same effect as sending it once,
+// like net/http does: as per its method, or an Idempotency-Key header.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+
+	_, hasKey := req.Header["Idempotency-Key"]
+	_, hasXKey := req.Header["X-Idempotency-Key"]
+
+	return hasKey || hasXKey
+}
+
+// retryableError tells if err means the request didn't reach the service, or didn't get a response at all.
+func retryableError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// roundTripWithRetries sends req to an upstream, then to the next ones as per us.Retry.
+func (us *Upstreams) roundTripWithRetries(req *http.Request) (*http.Response, error) {
+	cfg := us.Retry.withDefaults()
+	us.budget.deposit(cfg.Budget)
+
+	idempotent := isIdempotent(req)
+	body, replayable, err := replayableBody(req, idempotent, cfg.ReplayBufferSize)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), cfg.Timeout)
+	defer cancel()
+
+	backoff := &retry.ExpBackoff{MaxRetry: cfg.MaxRetries, MinInterval: cfg.Backoff, MaxInterval: time.Second}
+
+	var lastErr error
+	var lastBody *attemptBody
+	attempts := 0
+	resp, err := retry.RetryContext(ctx, func() (interface{}, error) {
+		attempt := req.Clone(req.Context())
+		// the trailers are set into the map of req once its body is read.
+		attempt.Trailer = req.Trailer
+		lastBody = nil
+		if body != nil {
+			lastBody = &attemptBody{body: body()}
+			attempt.Body = lastBody
+		}
+
+		resp, err := us.roundTrip(attempt, attempts > 0)
+		attempts++
+		lastErr = err
+
+		return resp, err
+	}, retry.AsBackoff(func(err error) (time.Duration, error) {
+		switch {
+		case !retryableError(err):
+		case !idempotent && !errors.Is(err, syscall.ECONNREFUSED) && (lastBody == nil || lastBody.read() > 0):
+		case idempotent && lastBody != nil && !replayable && lastBody.read() > 0:
+		case ctx.Err() != nil || req.Context().Err() != nil:
+		default:
+			duration, err := backoff.Backoff(err)
+			if err != nil || !us.budget.withdraw() {
+				break
+			}
+
+			return duration, nil
+		}
+
+		return 0, retry.EndOfRetry
+	}))
+
+	if err != nil {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+
+		return nil, lastErr
+	}
+
+	if lastBody != nil {
+		lastBody.succeeded()
+	}
+
+	return resp.(*http.Response), nil
+}
+
+// replayableBody returns a function giving the body of each attempt, nil without a body.
+// The body is buffered to be replayed if it's idempotent and up to size, otherwise it can be sent once only.
+func replayableBody(req *http.Request, idempotent bool, size int64) (func() io.ReadCloser, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, false, nil
+	}
+
+	original := req.Body
+	once := func() io.ReadCloser {
+		return original
+	}
+
+	if !idempotent || size <= 0 || req.ContentLength > size {
+		return once, false, nil
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(original, size+1))
+	if err != nil {
+		_ = original.Close()
+		return nil, false, err
+	}
+
+	if int64(len(buf)) > size {
+		// too large after all, what is buffered is sent before the rest.
+		prefixed := struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), original), original}
+
+		return func() io.ReadCloser { return prefixed }, false, nil
+	}
+
+	_ = original.Close()
+	if len(req.Trailer) == 0 {
+		// a body with trailers stays chunked.
+		req.ContentLength = int64(len(buf))
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf)), nil
+	}
+
+	return func() io.ReadCloser {
+		return ioutil.NopCloser(bytes.NewReader(buf))
+	}, true, nil
+}
+
+// attemptBody is the body of one attempt. It counts the bytes read to tell if the body was consumed,
+// and it's only closed for the attempt which succeeds, as the transport closes it on errors too.
+type attemptBody struct {
+	body    io.ReadCloser
+	n       int64
+	m       sync.Mutex
+	closed  bool
+	success bool
+}
+
+func (b *attemptBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+
+	return n, err
+}
+
+func (b *attemptBody) read() int64 {
+	return atomic.LoadInt64(&b.n)
+}
+
+func (b *attemptBody) Close() error {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.closed = true
+	if b.success {
+		return b.body.Close()
+	}
+
+	return nil
+}
+
+// succeeded closes the body if the transport is already done with it.
+func (b *attemptBody) succeeded() {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	b.success = true
+	if b.closed {
+		_ = b.body.Close()
+	}
+}
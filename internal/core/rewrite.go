@@ -0,0 +1,116 @@
+package core
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// pathRewriter adds the stripped service prefix back to the paths a response points the client to,
+// so that redirects and cookies of a service unaware of its prefix stay under its route.
+type pathRewriter struct {
+	prefix string
+	// host is the Host of the request, absolute urls to other hosts are left alone.
+	host string
+}
+
+// newPathRewriter returns nil when there is nothing to rewrite.
+func newPathRewriter(prefix, host string) *pathRewriter {
+	if prefix == "" {
+		return nil
+	}
+
+	return &pathRewriter{prefix: prefix, host: host}
+}
+
+// rewrite rewrites the Location, Content-Location, Refresh and Set-Cookie headers of h. A nil rewriter does nothing.
+func (r *pathRewriter) rewrite(h http.Header) {
+	if r == nil {
+		return
+	}
+
+	for _, k := range []string{"Location", "Content-Location"} {
+		for i, v := range h[k] {
+			h[k][i] = r.rewriteURL(v)
+		}
+	}
+
+	for i, v := range h["Refresh"] {
+		h["Refresh"][i] = r.rewriteRefresh(v)
+	}
+
+	for i, v := range h["Set-Cookie"] {
+		h["Set-Cookie"][i] = r.rewriteCookie(v)
+	}
+}
+
+// rewriteURL prefixes the path of an absolute path, or of an absolute url to the same host.
+// Relative paths are resolved by the client against the prefixed request path already.
+func (r *pathRewriter) rewriteURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Opaque != "" {
+		return rawURL
+	}
+
+	if u.Host != "" && !strings.EqualFold(u.Host, r.host) {
+		return rawURL
+	}
+
+	if u.Host == "" && (u.Scheme != "" || !strings.HasPrefix(u.Path, "/")) {
+		return rawURL
+	}
+
+	if !r.needsPrefix(u.Path) {
+		return rawURL
+	}
+
+	u.Path = r.prefix + u.Path
+	if u.RawPath != "" {
+		u.RawPath = r.prefix + u.RawPath
+	}
+
+	return u.String()
+}
+
+// rewriteRefresh rewrites the url of a Refresh header, e.g. "5; url=/login"
+func (r *pathRewriter) rewriteRefresh(refresh string) string {
+	i := strings.Index(strings.ToLower(refresh), "url=")
+	if i < 0 {
+		return refresh
+	}
+
+	start := i + len("url=")
+	rawURL := strings.Trim(refresh[start:], `"' `)
+
+	return refresh[:start] + r.rewriteURL(rawURL)
+}
+
+// rewriteCookie prefixes the Path attribute of a Set-Cookie header. A cookie without one defaults
+// to the prefixed request path already.
+func (r *pathRewriter) rewriteCookie(cookie string) string {
+	attrs := strings.Split(cookie, ";")
+	for i, attr := range attrs[1:] {
+		name, value := attr, ""
+		if j := strings.Index(attr, "="); j >= 0 {
+			name, value = attr[:j], attr[j+1:]
+		}
+
+		if !strings.EqualFold(strings.TrimSpace(name), "Path") {
+			continue
+		}
+
+		path := strings.TrimSpace(value)
+		if path == "/" {
+			attrs[i+1] = name + "=" + r.prefix
+		} else if strings.HasPrefix(path, "/") && r.needsPrefix(path) {
+			attrs[i+1] = name + "=" + r.prefix + path
+		}
+	}
+
+	return strings.Join(attrs, ";")
+}
+
+// needsPrefix is false for a path under the prefix already, e.g. from a service aware of X-Forwarded-Prefix.
+func (r *pathRewriter) needsPrefix(path string) bool {
+	return path != r.prefix && !strings.HasPrefix(path, r.prefix+"/")
+}
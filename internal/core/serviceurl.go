@@ -0,0 +1,150 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"golang.org/x/net/http2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const unixScheme = "unix:"
+
+// h2cScheme is the scheme of the services speaking HTTP/2 without TLS, e.g. gRPC services.
+const h2cScheme = "h2c:"
+
+// unixHost is the host of the requests sent over a unix socket. The Host header is still the one from the router.
+const unixHost = "localhost"
+
+// parseServiceURL returns the url which requests are resolved against, and the unix socket to dial if any.
+// A unix socket is given as unix:///path/to.sock, optionally followed by a base path, e.g. unix:///path/to.sock:/api
+// An h2c://host:port url is resolved as an http one.
+func parseServiceURL(serviceURL string) (*url.URL, string, error) {
+	if strings.HasPrefix(serviceURL, h2cScheme) {
+		base, err := url.Parse("http:" + strings.TrimPrefix(serviceURL, h2cScheme))
+		return base, "", err
+	}
+
+	if !strings.HasPrefix(serviceURL, unixScheme) {
+		base, err := url.Parse(serviceURL)
+		return base, "", err
+	}
+
+	socket := strings.TrimPrefix(strings.TrimPrefix(serviceURL, unixScheme), "//")
+	basePath := ""
+	if i := strings.Index(socket, ":"); i >= 0 {
+		socket, basePath = socket[:i], socket[i+1:]
+	}
+
+	if !strings.HasPrefix(socket, "/") {
+		return nil, "", fmt.Errorf("unix socket path must be absolute: %q", serviceURL)
+	}
+
+	if basePath != "" && !strings.HasPrefix(basePath, "/") {
+		return nil, "", fmt.Errorf("base path must start with /: %q", serviceURL)
+	}
+
+	base, err := url.Parse("http://" + unixHost + basePath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return base, socket, nil
+}
+
+// resolveServiceURL appends the path of req to the base path of the service.
+func resolveServiceURL(base *url.URL, req *url.URL) *url.URL {
+	if base.Path == "" || base.Path == "/" {
+		return base.ResolveReference(req)
+	}
+
+	target := *base
+	target.Path = strings.TrimSuffix(base.Path, "/") + req.Path
+	if req.RawPath != "" {
+		target.RawPath = strings.TrimSuffix(base.EscapedPath(), "/") + req.RawPath
+	}
+	target.RawQuery = req.RawQuery
+
+	return &target
+}
+
+// serviceClient returns client as is, or a copy of it dialing the unix socket of serviceURL,
+// or speaking HTTP/2 without TLS to an h2c serviceURL.
+func serviceClient(client *http.Client, serviceURL string) (*http.Client, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	_, socket, err := parseServiceURL(serviceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(serviceURL, h2cScheme) {
+		return h2cClient(client)
+	}
+
+	if socket == "" {
+		return client, nil
+	}
+
+	var transport *http.Transport
+	switch t := client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return nil, fmt.Errorf("a unix socket ServiceURL requires an *http.Transport, got %T", t)
+	}
+
+	dialer := &net.Dialer{}
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", socket)
+	}
+
+	unixClient := *client
+	unixClient.Transport = transport
+
+	return &unixClient, nil
+}
+
+// ValidateServiceURL returns an error if requests can't be sent to serviceURL with client.
+func ValidateServiceURL(serviceURL string, client *http.Client) error {
+	_, err := serviceClient(client, serviceURL)
+	if err != nil {
+		return fmt.Errorf("invalid ServiceURL: %w", err)
+	}
+
+	return nil
+}
+
+// h2cClient returns a copy of client sending requests with HTTP/2 over plain TCP connections, dialed as per
+// the transport of client if it's an *http.Transport. Request and response bodies are streamed at the same time,
+// and trailers are received after the response body.
+func h2cClient(client *http.Client) (*http.Client, error) {
+	dial := (&net.Dialer{}).DialContext
+	switch t := client.Transport.(type) {
+	case nil:
+	case *http.Transport:
+		if t.DialContext != nil {
+			dial = t.DialContext
+		}
+	default:
+		return nil, fmt.Errorf("an h2c ServiceURL requires an *http.Transport, got %T", t)
+	}
+
+	h2cClient := *client
+	h2cClient.Transport = &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		},
+	}
+
+	return &h2cClient, nil
+}
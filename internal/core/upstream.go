@@ -0,0 +1,368 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LoadBalancing is how an upstream is picked for a request.
+type LoadBalancing string
+
+const (
+	RoundRobin    LoadBalancing = "round-robin"
+	LeastInFlight LoadBalancing = "least-in-flight"
+	Random        LoadBalancing = "random"
+)
+
+// HealthCheck configures the active health checks of upstreams.
+type HealthCheck struct {
+	// Path is requested with GET on each upstream, a 2xx or 3xx response means healthy. Empty means no active checks.
+	Path string
+	// Interval between checks, 10s by default.
+	Interval time.Duration
+	// Timeout of a check, 2s by default.
+	Timeout time.Duration
+	// UnhealthyThreshold is the number of consecutive failed checks to mark an upstream unhealthy, 2 by default.
+	// A single successful check marks it healthy again.
+	UnhealthyThreshold int
+}
+
+// OutlierDetection configures the passive ejection of upstreams failing requests.
+type OutlierDetection struct {
+	// ConsecutiveFailures is the number of consecutive 5xx responses or connection errors to eject an upstream.
+	// Zero means never eject.
+	ConsecutiveFailures int
+	// EjectionTime is how long an upstream is ejected for, 30s by default.
+	EjectionTime time.Duration
+}
+
+// UpstreamStatus is a snapshot of an upstream.
+type UpstreamStatus struct {
+	URL string
+	// Healthy is false once the active health checks fail.
+	Healthy bool
+	// EjectedUntil is set while the upstream is ejected by outlier detection.
+	EjectedUntil time.Time
+	InFlight     int64
+	Requests     uint64
+	Failures     uint64
+	// Retries are the requests which were retries of failed ones, they count in Requests too.
+	Retries   uint64
+	LastError string
+}
+
+type upstream struct {
+	base     *url.URL
+	client   *http.Client
+	inFlight int64
+	m        sync.Mutex
+	status   UpstreamStatus
+	// failures are consecutive failed requests, checkFailures consecutive failed health checks.
+	failures      int
+	checkFailures int
+	// ownClient tells if client is made for this upstream, e.g. for an h2c ServiceURL, rather than shared.
+	ownClient bool
+}
+
+// Upstreams are the replicas of a service, requests are balanced between them.
+type Upstreams struct {
+	LoadBalancing    LoadBalancing
+	HealthCheck      HealthCheck
+	OutlierDetection OutlierDetection
+	// Retry configures the retries of the requests failing to reach an upstream, there are none by default.
+	Retry     Retry
+	budget    retryBudget
+	upstreams []*upstream
+	next      uint32
+}
+
+// NewUpstreams returns the Upstreams for serviceURLs, which are sent requests with client.
+func NewUpstreams(serviceURLs []string, client *http.Client) (*Upstreams, error) {
+	if len(serviceURLs) == 0 {
+		return nil, errors.New("requires ServiceURL")
+	}
+
+	us := &Upstreams{budget: retryBudget{tokens: retryReserve}}
+	for _, serviceURL := range serviceURLs {
+		err := ValidateServiceURL(serviceURL, client)
+		if err != nil {
+			return nil, err
+		}
+
+		// a valid serviceURL is parsed and given a client without errors.
+		base, _, _ := parseServiceURL(serviceURL)
+		c, _ := serviceClient(client, serviceURL)
+
+		us.upstreams = append(us.upstreams, &upstream{
+			base:      base,
+			client:    c,
+			ownClient: c != client && c != http.DefaultClient,
+			status:    UpstreamStatus{URL: serviceURL, Healthy: true},
+		})
+	}
+
+	return us, nil
+}
+
+// closeIdleConnections closes the idle connections of the clients made for the upstreams, once they're not used anymore.
+func (us *Upstreams) closeIdleConnections() {
+	for _, u := range us.upstreams {
+		if u.ownClient {
+			u.client.CloseIdleConnections()
+		}
+	}
+}
+
+// Status returns a snapshot of every upstream.
+func (us *Upstreams) Status() []UpstreamStatus {
+	statuses := make([]UpstreamStatus, len(us.upstreams))
+	for i, u := range us.upstreams {
+		u.m.Lock()
+		statuses[i] = u.status
+		u.m.Unlock()
+		statuses[i].InFlight = atomic.LoadInt64(&u.inFlight)
+	}
+
+	return statuses
+}
+
+// pick returns the upstream for the next request. Call done on it once the response is sent.
+// When no upstream is available, all of them are, rather than failing every request on a false positive.
+func (us *Upstreams) pick() (*upstream, error) {
+	if us == nil || len(us.upstreams) == 0 {
+		return nil, errNoUpstream
+	}
+
+	now := time.Now()
+	available := make([]*upstream, 0, len(us.upstreams))
+	for _, u := range us.upstreams {
+		if u.available(now) {
+			available = append(available, u)
+		}
+	}
+
+	if len(available) == 0 {
+		available = us.upstreams
+	}
+
+	var picked *upstream
+	switch us.LoadBalancing {
+	case Random:
+		picked = available[rand.Intn(len(available))]
+	case LeastInFlight:
+		offset := int(atomic.AddUint32(&us.next, 1))
+		for i := range available {
+			u := available[(offset+i)%len(available)]
+			if picked == nil || atomic.LoadInt64(&u.inFlight) < atomic.LoadInt64(&picked.inFlight) {
+				picked = u
+			}
+		}
+	default:
+		picked = available[int(atomic.AddUint32(&us.next, 1)-1)%len(available)]
+	}
+
+	atomic.AddInt64(&picked.inFlight, 1)
+
+	return picked, nil
+}
+
+// RoundTrip sends req to one of the upstreams. The upstream counts the request in-flight until the response body is closed.
+func (us *Upstreams) RoundTrip(req *http.Request) (*http.Response, error) {
+	if us != nil && us.Retry.MaxRetries > 0 {
+		return us.roundTripWithRetries(req)
+	}
+
+	return us.roundTrip(req, false)
+}
+
+// roundTrip sends req to one upstream. retried tells if it's a retry.
+func (us *Upstreams) roundTrip(req *http.Request, retried bool) (*http.Response, error) {
+	u, err := us.pick()
+	if err != nil {
+		return nil, err
+	}
+
+	req.URL = resolveServiceURL(u.base, req.URL)
+	req.RequestURI = ""
+
+	resp, err := u.client.Do(req)
+	if req.Context().Err() == nil {
+		us.report(u, resp, err, retried)
+	}
+
+	if err != nil {
+		u.done()
+		return nil, err
+	}
+
+	resp.Body = &doneOnClose{ReadCloser: resp.Body, done: u.done}
+
+	return resp, nil
+}
+
+func (u *upstream) done() {
+	atomic.AddInt64(&u.inFlight, -1)
+}
+
+// doneOnClose calls done once the body is closed.
+type doneOnClose struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *doneOnClose) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
+
+func (u *upstream) available(now time.Time) bool {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	return u.status.Healthy && !now.Before(u.status.EjectedUntil)
+}
+
+// report records the outcome of a request for outlier detection. Cancelled requests don't count.
+func (us *Upstreams) report(u *upstream, resp *http.Response, err error, retried bool) {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	u.status.Requests++
+	if retried {
+		u.status.Retries++
+	}
+	if err == nil && resp.StatusCode < 500 {
+		u.failures = 0
+		return
+	}
+
+	u.status.Failures++
+	u.failures++
+	if err != nil {
+		u.status.LastError = err.Error()
+	} else {
+		u.status.LastError = resp.Status
+	}
+
+	od := us.OutlierDetection
+	if od.ConsecutiveFailures > 0 && u.failures >= od.ConsecutiveFailures {
+		ejectionTime := od.EjectionTime
+		if ejectionTime == 0 {
+			ejectionTime = 30 * time.Second
+		}
+
+		u.status.EjectedUntil = time.Now().Add(ejectionTime)
+		u.failures = 0
+	}
+}
+
+// RunHealthChecks checks every upstream until ctx is done. It returns right away if there is no HealthCheck.Path.
+func (us *Upstreams) RunHealthChecks(ctx context.Context) {
+	hc := us.HealthCheck
+	if hc.Path == "" {
+		return
+	}
+
+	if hc.Interval == 0 {
+		hc.Interval = 10 * time.Second
+	}
+
+	if hc.Timeout == 0 {
+		hc.Timeout = 2 * time.Second
+	}
+
+	if hc.UnhealthyThreshold == 0 {
+		hc.UnhealthyThreshold = 2
+	}
+
+	for {
+		wg := &sync.WaitGroup{}
+		for _, u := range us.upstreams {
+			wg.Add(1)
+			go func(u *upstream) {
+				defer wg.Done()
+				u.check(ctx, hc)
+			}(u)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(hc.Interval):
+		}
+	}
+}
+
+// Probe requests path on every upstream. It returns nil as soon as one of them answers with a 2xx or 3xx.
+func (us *Upstreams) Probe(ctx context.Context, path string) error {
+	var err error
+	for _, u := range us.upstreams {
+		err = u.probe(ctx, path)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func (u *upstream) check(ctx context.Context, hc HealthCheck) {
+	ctx, cancel := context.WithTimeout(ctx, hc.Timeout)
+	defer cancel()
+
+	err := u.probe(ctx, hc.Path)
+	if ctx.Err() == context.Canceled {
+		// shutting down, not a failure of the upstream
+		return
+	}
+
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	if err == nil {
+		u.checkFailures = 0
+		u.status.Healthy = true
+		return
+	}
+
+	u.checkFailures++
+	u.status.LastError = err.Error()
+	if u.checkFailures >= hc.UnhealthyThreshold {
+		u.status.Healthy = false
+	}
+}
+
+func (u *upstream) probe(ctx context.Context, path string) error {
+	ref, err := url.Parse(path)
+	if err != nil {
+		return err
+	}
+
+	checkURL := resolveServiceURL(u.base, ref)
+	req, err := http.NewRequest(http.MethodGet, checkURL.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := u.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("health check failed: %s", resp.Status)
+	}
+
+	return nil
+}
@@ -4,83 +4,323 @@ import (
 	"context"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"golang.org/x/sync/semaphore"
+	"net"
 	"net/http"
+	"nhooyr.io/websocket"
 	"sync"
 	"time"
 )
 
+const deregisterTimeout = 5 * time.Second
+
+// recycleRetryInterval is how long an expired idle socket is kept when its replacement can't be connected,
+// before trying again.
+const recycleRetryInterval = 5 * time.Second
+
 // WSSConnector connects to a single cranker wss url.
 type WSSConnector struct {
-	ServiceName       string
-	ServiceURL        string
-	RegisterURL       string
-	SlidingWindow     int8
-	ShutdownTimeout   time.Duration
+	ServiceName         string
+	ServiceURL          string
+	RegisterURL         string
+	ConnectorInstanceID string
+	SlidingWindow       int8
+	// Upstreams are where requests are sent, a single upstream for ServiceURL when nil.
+	Upstreams *Upstreams
+	// Handler serves the requests in-process instead of proxying them to ServiceURL, when it's not nil.
+	Handler http.Handler
+	// Accept is given a net.Conn per request instead of proxying it to ServiceURL, when it's not nil.
+	Accept func(ctx context.Context, conn net.Conn) error
+	// Forwarder sets the forwarding headers of the requests, every router is trusted when it's nil.
+	Forwarder *Forwarder
+	// BodyLimit returns the maximum body size of a request, zero meaning no limit. There is none when it's nil.
+	BodyLimit func(req *http.Request) int64
+	// MaxHeaderBytes and MaxHeaders limit the size of the request head and the number of header values, when not zero.
+	MaxHeaderBytes int
+	MaxHeaders     int
+	// MaxMessageSize is the read limit of the websocket messages, the websocket library's 32 KB when zero.
+	// The Connector defaults it to MaxHeaderBytes and 4 KB, i.e. 1 MB and 4 KB, or 32 KB if that's less.
+	MaxMessageSize int64
+	// ErrorPages customizes the responses to the requests which can't be proxied.
+	ErrorPages ErrorPages
+	// RewritePaths adds the service prefix back to the redirects and cookie paths of the responses.
+	RewritePaths bool
+	// Compression gzips the responses proxied from the service when not nil.
+	Compression *Compression
+	// Middleware wraps the requests sent to Upstreams, the first one being the outermost.
+	Middleware []Middleware
+	// MaxSocketIdleAge is how long a socket is offered to the router before it's replaced. Zero means forever.
+	MaxSocketIdleAge time.Duration
+	// MaxSocketLifetime is how long a socket lives at most after it's connected. Zero means forever.
+	// An idle socket is replaced once it expires, and an in-flight request still running then is cancelled.
+	MaxSocketLifetime time.Duration
 	WSSHttpClient     *http.Client
 	ServiceHttpClient *http.Client
-	terminate         context.CancelFunc
+	once              sync.Once
+	m                 sync.Mutex
+	gen               *generation
+	sigDrain          context.Context
+	drain             context.CancelFunc
+	sigKill           context.Context
+	kill              context.CancelFunc
 	wg                *sync.WaitGroup
 	log               zerolog.Logger
 }
 
-// ConnectAndServe blocks until the *WSSConnector.Shutdown() is called.
+func (wss *WSSConnector) init() {
+	wss.once.Do(func() {
+		wss.log = log.With().
+			Str("serviceURL", wss.ServiceURL).
+			Str("serviceName", wss.ServiceName).
+			Str("registerURL", wss.RegisterURL).
+			Logger()
+
+		wss.sigKill, wss.kill = context.WithCancel(context.Background())
+		wss.sigDrain, wss.drain = context.WithCancel(wss.sigKill)
+		wss.wg = &sync.WaitGroup{}
+		wss.gen = newGeneration(wss.sigDrain, Settings{
+			ServiceName:   wss.ServiceName,
+			ServiceURL:    wss.ServiceURL,
+			SlidingWindow: wss.SlidingWindow,
+			Upstreams:     wss.Upstreams,
+		}, wss.ServiceHttpClient, wss.Middleware)
+	})
+}
+
+// ConnectAndServe blocks until the *WSSConnector.Drain() or *WSSConnector.Shutdown() is called.
 func (wss *WSSConnector) ConnectAndServe() error {
-	wss.log = log.With().
-		Str("serviceURL", wss.ServiceURL).
-		Str("serviceName", wss.ServiceName).
-		Str("registerURL", wss.RegisterURL).
-		Logger()
+	wss.init()
 
-	wss.log.Info().Msg("ConnectAndServe starting")
+	wss.m.Lock()
+	if wss.sigDrain.Err() != nil {
+		wss.m.Unlock()
+		return wss.sigDrain.Err()
+	}
+	wss.wg.Add(1)
+	wss.m.Unlock()
+	defer wss.wg.Done()
 
-	var sem *semaphore.Weighted = semaphore.NewWeighted(int64(wss.SlidingWindow))
-	sigTerm, terminate := context.WithCancel(context.Background())
-	defer terminate()
-	wss.terminate = terminate
-	wss.wg = &sync.WaitGroup{}
+	wss.log.Info().Msg("ConnectAndServe starting")
 
 	for {
-		select {
-		case <-sigTerm.Done():
-			wss.log.Info().Msg("terminating...")
-			return sigTerm.Err()
-		default:
-			err := sem.Acquire(sigTerm, 1)
+		gen := wss.current()
+		err := gen.sem.Acquire(gen.sigActive, 1)
+		if err != nil {
+			if wss.sigDrain.Err() != nil {
+				wss.log.Info().Msg("terminating...")
+				return wss.sigDrain.Err()
+			}
+
+			// superseded by Reconfigure, carry on with the new generation.
+			continue
+		}
+
+		wss.wg.Add(1)
+		go func() {
+			defer wss.wg.Done()
+
+			p := newPermit(gen.sem)
+			worker := wss.newWorker(gen)
+			err := worker.Dial(gen.sigIdle, wss.sigKill, wss.WSSHttpClient)
 			if err != nil {
-				return err
+				p.release()
+				wss.log.Err(err).Msg("failed to dial")
+				return
 			}
 
-			wss.wg.Add(1)
-			go func() {
-				defer wss.wg.Done()
-
-				var worker *WssWorker = &WssWorker{
-					ServiceName:     wss.ServiceName,
-					RegisterURL:     wss.RegisterURL,
-					ServiceURL:      wss.ServiceURL,
-					ShutdownTimeout: wss.ShutdownTimeout,
-				}
-
-				err := worker.Dial(sigTerm, wss.WSSHttpClient)
-				if err != nil {
-					wss.log.Err(err).Msg("failed to dial")
-					return
-				}
-
-				err = worker.Serve(sigTerm, sem, wss.ServiceHttpClient)
-				if err != nil {
-					wss.log.Err(err).Msg("failed to serve")
-					return
-				}
-			}()
+			gen.onConnected()
+			wss.serve(gen, worker, p)
+		}()
+	}
+}
+
+func (wss *WSSConnector) newWorker(gen *generation) *WssWorker {
+	worker := &WssWorker{
+		ServiceName:         gen.ServiceName,
+		RegisterURL:         wss.RegisterURL,
+		ConnectorInstanceID: wss.ConnectorInstanceID,
+		ServiceURL:          gen.ServiceURL,
+		Handler:             wss.Handler,
+		Accept:              wss.Accept,
+		Forwarder:           wss.Forwarder,
+		RewritePaths:        wss.RewritePaths,
+		Compression:         wss.Compression,
+		ErrorPages:          wss.ErrorPages,
+		BodyLimit:           wss.BodyLimit,
+		MaxHeaderBytes:      wss.MaxHeaderBytes,
+		MaxHeaders:          wss.MaxHeaders,
+		MaxMessageSize:      wss.MaxMessageSize,
+		sigShutdown:         wss.sigDrain,
+		MaxIdle:             wss.MaxSocketIdleAge,
+		MaxLifetime:         wss.MaxSocketLifetime,
+	}
+
+	worker.Recycle = func(old *WssWorker) bool {
+		return wss.recycle(gen, old)
+	}
+
+	return worker
+}
+
+func (wss *WSSConnector) serve(gen *generation, worker *WssWorker, p *permit) {
+	err := worker.Serve(gen.sigIdle, wss.sigKill, p, gen.transport)
+	if err != nil {
+		wss.log.Err(err).Msg("failed to serve")
+	}
+}
+
+// recycle replaces an expired idle socket. The replacement is connected first and takes over the permit of old,
+// then old is closed, so that the router never sees the number of idle sockets drop.
+// If old picked up a request in the meantime, the replacement is kept only if the sliding window has room for it.
+// It returns false if the replacement can't be connected, old is kept until it's recycled again.
+func (wss *WSSConnector) recycle(gen *generation, old *WssWorker) bool {
+	if gen.sigActive.Err() != nil {
+		// superseded or draining, old is closed with its generation.
+		return true
+	}
+
+	worker := wss.newWorker(gen)
+	err := worker.Dial(gen.sigIdle, wss.sigKill, wss.WSSHttpClient)
+	if err != nil {
+		wss.log.Err(err).Msg("failed to dial replacement, keeping the expired socket for now")
+		return false
+	}
+
+	p, ok := old.permit.handOver()
+	if ok {
+		old.retire()
+	} else if gen.sem.TryAcquire(1) {
+		p = newPermit(gen.sem)
+	} else {
+		worker.Close()
+		return true
+	}
+
+	// old is served by a goroutine tracked by wg, which can't be waited for yet.
+	wss.wg.Add(1)
+	go func() {
+		defer wss.wg.Done()
+		wss.serve(gen, worker, p)
+	}()
+
+	return true
+}
+
+func (wss *WSSConnector) current() *generation {
+	wss.m.Lock()
+	defer wss.m.Unlock()
+
+	return wss.gen
+}
+
+// Reconfigure switches to new Settings without a traffic blip: sockets with the new Settings are connected first,
+// then the idle sockets with the old ones are closed. In-flight requests finish with the old Settings.
+func (wss *WSSConnector) Reconfigure(settings Settings) {
+	wss.init()
+
+	wss.m.Lock()
+	prev := wss.gen
+	next := newGeneration(wss.sigDrain, settings, wss.ServiceHttpClient, wss.Middleware)
+	wss.gen = next
+	prev.supersede()
+	if wss.sigDrain.Err() != nil {
+		wss.m.Unlock()
+		return
+	}
+	wss.wg.Add(1)
+	wss.m.Unlock()
+
+	wss.log.Info().
+		Str("newServiceURL", settings.ServiceURL).
+		Str("newServiceName", settings.ServiceName).
+		Int8("newSlidingWindow", settings.SlidingWindow).
+		Msg("reconfiguring")
+
+	go func() {
+		defer wss.wg.Done()
+
+		select {
+		case <-next.ready:
+		case <-next.sigIdle.Done():
+			// next is retired by an even newer generation, which is ready.
 		}
+
+		wss.log.Info().Msg("retiring idle sockets with previous settings")
+		prev.retire()
+	}()
+}
+
+// Drain stops offering idle sockets to the router and waits for in-flight requests to finish.
+// The router is asked to deregister this connector first, so that it stops picking sockets which are about to close.
+// It returns ctx.Err() if in-flight requests are still running when ctx is done. They are not cancelled.
+func (wss *WSSConnector) Drain(ctx context.Context) error {
+	wss.init()
+	wss.log.Info().Msg("draining")
+
+	wss.deregister(ctx)
+
+	wss.m.Lock()
+	wss.drain()
+	wss.m.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		wss.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		wss.log.Info().Msg("wss connector is drained")
+		return nil
+	case <-ctx.Done():
+		wss.log.Warn().Msg("in-flight requests still running after drain")
+		return ctx.Err()
+	}
+}
+
+// deregister is best-effort. Routers which don't support it simply see the idle sockets closed by Drain.
+func (wss *WSSConnector) deregister(ctx context.Context) {
+	if wss.sigDrain.Err() != nil || wss.ConnectorInstanceID == "" {
+		return
+	}
+
+	serviceName := wss.current().ServiceName
+	deregURL, err := deregisterURL(wss.RegisterURL, wss.ConnectorInstanceID, serviceName)
+	if err != nil {
+		wss.log.Err(err).Msg("failed to build deregister url")
+		return
 	}
+
+	ctx, cancel := context.WithTimeout(ctx, deregisterTimeout)
+	defer cancel()
+
+	conn, _, err := websocket.Dial(ctx, deregURL, &websocket.DialOptions{
+		HTTPClient: wss.WSSHttpClient,
+		HTTPHeader: crankerHeaders(serviceName),
+	})
+	if err != nil {
+		wss.log.Warn().Err(err).Msg("failed to deregister from cranker router")
+		return
+	}
+
+	wss.log.Info().Str("deregisterURL", deregURL).Msg("deregistered")
+	_ = conn.Close(websocket.StatusNormalClosure, "deregistered")
 }
 
-func (wss *WSSConnector) Shutdown() {
+// Shutdown drains the WSSConnector until ctx is done, then cancels whatever is still running.
+// It returns ctx.Err() if any in-flight request had to be cancelled.
+func (wss *WSSConnector) Shutdown(ctx context.Context) error {
+	wss.init()
 	wss.log.Info().Msg("shutting down")
-	wss.terminate()
+
+	err := wss.Drain(ctx)
+	if err != nil {
+		wss.log.Warn().Msg("cancelling in-flight requests")
+	}
+
+	wss.kill()
 	wss.wg.Wait()
 	wss.log.Info().Msg("wss connector is down")
+
+	return err
 }
@@ -6,18 +6,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"github.com/JackKCWong/go-cranker-connector/internal/util"
 	"github.com/JackKCWong/go-cranker-connector/internal/util/pools"
 	"github.com/JackKCWong/go-cranker-connector/internal/util/retry"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"golang.org/x/sync/semaphore"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
-	"net/url"
+	"net/http/httptrace"
 	"nhooyr.io/websocket"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"time"
@@ -31,14 +31,58 @@ var raw8kBuffers *sync.Pool = &sync.Pool{
 }
 
 type WssWorker struct {
-	ID              string
-	ServiceName     string
-	RegisterURL     string
-	ServiceURL      string
-	ShutdownTimeout time.Duration
-	log             zerolog.Logger
-	conn            *websocket.Conn
-	servicePrefix   string
+	ID                  string
+	ServiceName         string
+	RegisterURL         string
+	ConnectorInstanceID string
+	ServiceURL          string
+	// Handler serves the requests in-process instead of proxying them to ServiceURL, when it's not nil.
+	Handler http.Handler
+	// Accept is given a net.Conn carrying the request instead of proxying it to ServiceURL, when it's not nil.
+	// It returns an error if the connection can't be accepted.
+	Accept func(ctx context.Context, conn net.Conn) error
+	// Forwarder sets the forwarding headers of the requests, every router is trusted when it's nil.
+	Forwarder *Forwarder
+	// BodyLimit returns the maximum body size of a request, zero meaning no limit. There is none when it's nil.
+	BodyLimit func(req *http.Request) int64
+	// MaxHeaderBytes and MaxHeaders limit the size of the request head and the number of header values, when not zero.
+	MaxHeaderBytes int
+	MaxHeaders     int
+	// MaxMessageSize is the read limit of the websocket messages, see WSSConnector.MaxMessageSize.
+	MaxMessageSize int64
+	// ErrorPages customizes the responses to the requests which can't be proxied.
+	ErrorPages ErrorPages
+	// RewritePaths adds the service prefix back to the redirects and cookie paths of the responses.
+	RewritePaths bool
+	// Compression gzips the responses proxied from the service when not nil.
+	Compression *Compression
+	// MaxIdle is how long the connection waits for a request before Recycle is called. Zero means forever.
+	MaxIdle time.Duration
+	// MaxLifetime is how long the connection lives at most after it's connected. Zero means forever.
+	// Recycle is called once it expires while idle, and an in-flight request still running then is cancelled.
+	MaxLifetime time.Duration
+	// Recycle is expected to connect a replacement, take over the permit and retire this worker.
+	// It returns false if the replacement can't be connected, in which case it's called again later.
+	Recycle       func(w *WssWorker) bool
+	log           zerolog.Logger
+	conn          *websocket.Conn
+	servicePrefix string
+	// routerAddr is the address the connection is dialed to, the remote address of the requests.
+	routerAddr string
+	// proto is the protocol the clients are assumed to use, after the scheme of the router.
+	proto string
+	// trailers tells if the router picked TrailersSubprotocol.
+	trailers bool
+	rewriter *pathRewriter
+	// sigShutdown is done once the connector is shutting down, requests failing then are answered with a 503.
+	sigShutdown context.Context
+	stopPing    context.CancelFunc
+	permit      *permit
+	retire      context.CancelFunc
+	// connected is when the connection was dialed.
+	connected time.Time
+	// bg tracks the goroutines started for the connection
+	bg sync.WaitGroup
 }
 
 func (w *WssWorker) init() error {
@@ -51,11 +95,16 @@ func (w *WssWorker) init() error {
 		Logger()
 
 	w.servicePrefix = "/" + w.ServiceName
+	w.proto = "http"
+	if strings.HasPrefix(w.RegisterURL, "wss:") || strings.HasPrefix(w.RegisterURL, "https:") {
+		w.proto = "https"
+	}
 
 	return nil
 }
 
-func (w *WssWorker) Dial(sigTerm context.Context, hc *http.Client) error {
+// Dial connects to the router. sigDrain stops dialing, sigKill bounds the lifetime of the connection.
+func (w *WssWorker) Dial(sigDrain, sigKill context.Context, hc *http.Client) error {
 	err := w.init()
 	w.log.Info().Msg("dialing")
 	if err != nil {
@@ -63,22 +112,33 @@ func (w *WssWorker) Dial(sigTerm context.Context, hc *http.Client) error {
 		return err
 	}
 
-	headers := http.Header{}
-	headers.Add("CrankerProtocol", "1.0")
-	headers.Add("Route", w.ServiceName)
+	dialURL, err := registerURL(w.RegisterURL, w.ConnectorInstanceID)
+	if err != nil {
+		w.log.Err(err).Msg("invalid register url")
+		return err
+	}
+
+	headers := crankerHeaders(w.ServiceName)
 
 	backoff := retry.Randomize(&retry.ExpBackoff{MinInterval: 5 * time.Second, MaxInterval: 30 * time.Second}, 5*time.Second)
 
-	conn, err := retry.Retry(func() (interface{}, error) {
-		dialCtx, cancelDial := context.WithTimeout(sigTerm, 30*time.Second)
+	conn, err := retry.RetryContext(sigDrain, func() (interface{}, error) {
+		dialCtx, cancelDial := context.WithTimeout(sigDrain, 30*time.Second)
 		defer cancelDial()
 
+		dialCtx = httptrace.WithClientTrace(dialCtx, &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				w.routerAddr = info.Conn.RemoteAddr().String()
+			},
+		})
+
 		conn, resp, err := websocket.Dial(
 			dialCtx,
-			w.RegisterURL,
+			dialURL,
 			&websocket.DialOptions{
-				HTTPClient: hc,
-				HTTPHeader: headers,
+				HTTPClient:   hc,
+				HTTPHeader:   headers,
+				Subprotocols: []string{TrailersSubprotocol},
 			})
 
 		if err != nil {
@@ -115,12 +175,31 @@ func (w *WssWorker) Dial(sigTerm context.Context, hc *http.Client) error {
 	}
 
 	w.conn = conn.(*websocket.Conn)
+	w.connected = time.Now()
+	w.trailers = w.conn.Subprotocol() == TrailersSubprotocol
+	if w.MaxMessageSize > 0 {
+		w.conn.SetReadLimit(w.MaxMessageSize)
+	}
 
+	// pinging stops when Serve returns.
+	var pingCtx context.Context
+	pingCtx, w.stopPing = context.WithCancel(sigKill)
+	w.bg.Add(1)
 	go func(conn *websocket.Conn) {
+		defer w.bg.Done()
 		for {
-			<-time.After(1 * time.Minute)
-			err := conn.Ping(sigTerm)
+			select {
+			case <-pingCtx.Done():
+				return
+			case <-time.After(1 * time.Minute):
+			}
+
+			err := conn.Ping(pingCtx)
 			if err != nil {
+				if pingCtx.Err() != nil {
+					return
+				}
+
 				if strings.Contains(err.Error(), "response finished") {
 					// normal closure, do nothing.
 					return
@@ -141,13 +220,17 @@ func (w *WssWorker) Dial(sigTerm context.Context, hc *http.Client) error {
 	return nil
 }
 
-func (w *WssWorker) nextRequest(sigTerm context.Context, buf []byte) (*http.Request, error) {
-	messageType, message, err := w.conn.Reader(sigTerm)
+// nextRequest waits for a request while idle. Once a request arrives, it is bound to sigKill only.
+func (w *WssWorker) nextRequest(sigDrain, sigKill context.Context, buf []byte) (*http.Request, error) {
+	messageType, message, err := w.conn.Reader(sigDrain)
 
 	if err != nil {
 		return nil, fmt.Errorf("RequestReaderError: %w", err)
 	}
 
+	// no longer idle, so it can't be handed over to a replacement anymore.
+	w.permit.release()
+
 	w.log.Debug().Msg("request available")
 
 	if messageType != websocket.MessageText {
@@ -161,10 +244,30 @@ func (w *WssWorker) nextRequest(sigTerm context.Context, buf []byte) (*http.Requ
 
 	headers := buffers.Get()
 	defer buffers.Release(headers)
-	headerSize, err := io.CopyBuffer(headers, message, buf)
+
+	// the head is read up to a byte over the limit, the marker aside.
+	var head io.Reader = message
+	if w.MaxHeaderBytes > 0 {
+		head = io.LimitReader(message, int64(w.MaxHeaderBytes)+3)
+	}
+	headerSize, err := io.CopyBuffer(headers, head, buf)
 
 	if err != nil && err != io.EOF {
-		return nil, fmt.Errorf("RequestReadError: %w", err)
+		return nil, w.readError("RequestReadError", "request head", headerSize, err)
+	}
+
+	if w.MaxHeaderBytes > 0 && headerSize > int64(w.MaxHeaderBytes)+2 {
+		// the rest of the head is discarded, so that the socket is left in a state to send the 431.
+		n, err := io.CopyBuffer(ioutil.Discard, message, buf)
+		if err != nil {
+			return nil, w.readError("RequestReadError", "request head", headerSize+n, err)
+		}
+
+		return nil, fmt.Errorf("%w: over %d bytes", ErrHeadTooLarge, w.MaxHeaderBytes)
+	}
+
+	if headerSize < 2 {
+		return nil, errors.New("CrankerProtoError: request head without marker")
 	}
 
 	w.log.Debug().Int64("bytesRecv", headerSize).Msg("received headers")
@@ -180,9 +283,14 @@ func (w *WssWorker) nextRequest(sigTerm context.Context, buf []byte) (*http.Requ
 		Str("url", req.URL.String()).
 		Msg("received request")
 
-	req.URL.Path = strings.TrimPrefix(req.URL.Path, w.servicePrefix)
+	err = checkHead(headerSize-2, req.Header, w.MaxHeaderBytes, w.MaxHeaders)
+	if err != nil {
+		return nil, err
+	}
 
-	sigKill := util.WithGrace(sigTerm, w.ShutdownTimeout)
+	req.RemoteAddr = w.routerAddr
+	req.URL.Path = strings.TrimPrefix(req.URL.Path, w.servicePrefix)
+	req.URL.RawPath = strings.TrimPrefix(req.URL.RawPath, w.servicePrefix)
 
 	if bytes.Compare(marker, []byte(MarkerReqHasNoBody)) == 0 {
 		w.log.Debug().Msg("request without body")
@@ -190,7 +298,18 @@ func (w *WssWorker) nextRequest(sigTerm context.Context, buf []byte) (*http.Requ
 		w.log.Debug().Msg("request with body")
 		in, out := io.Pipe()
 		req.Body = in
-		go w.pumpRequestBody(sigKill, out)
+		// the trailers are announced by a router taking them, the others drop them.
+		req.Trailer = nil
+		var body *trailerReader
+		if trailer := announcedTrailer(req.Header); w.trailers && len(trailer) > 0 {
+			body = &trailerReader{PipeReader: in, trailer: trailer}
+			req.Body, req.Trailer = body, trailer
+		}
+		w.bg.Add(1)
+		go func() {
+			defer w.bg.Done()
+			w.pumpRequestBody(sigKill, out, body)
+		}()
 	} else {
 		w.log.Error().Bytes("marker", marker).Msg("unexpected marker")
 		return nil, errors.New("UnexpectedMarker")
@@ -199,7 +318,35 @@ func (w *WssWorker) nextRequest(sigTerm context.Context, buf []byte) (*http.Requ
 	return req.WithContext(sigKill), nil
 }
 
-func (w *WssWorker) pumpRequestBody(ctx context.Context, out *io.PipeWriter) {
+// recycleWhenExpired calls Recycle once the connection has waited MaxIdle for a request, or reached MaxLifetime,
+// and again every recycleRetryInterval until a replacement takes over or a request arrives.
+func (w *WssWorker) recycleWhenExpired(waiting context.Context) {
+	wait := w.MaxIdle
+	if left := time.Until(w.connected.Add(w.MaxLifetime)); w.MaxLifetime > 0 && (wait == 0 || left < wait) {
+		wait = left
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-waiting.Done():
+			return
+		case <-timer.C:
+		}
+
+		w.log.Info().Msg("recycling idle connection")
+		if w.Recycle(w) {
+			return
+		}
+
+		timer.Reset(recycleRetryInterval)
+	}
+}
+
+// pumpRequestBody writes the body of a request to out. Its trailers are handed to body, which is nil if none are announced.
+func (w *WssWorker) pumpRequestBody(ctx context.Context, out *io.PipeWriter, body *trailerReader) {
 	buf := raw8kBuffers.Get().([]byte)
 	defer raw8kBuffers.Put(buf)
 
@@ -210,6 +357,7 @@ func (w *WssWorker) pumpRequestBody(ctx context.Context, out *io.PipeWriter) {
 			w.log.Error().
 				AnErr("err", err).
 				Msg("failed to create reader for request body")
+			_ = out.CloseWithError(w.readError("RequestBodyError", "request body", 0, err))
 			return
 		}
 
@@ -220,47 +368,83 @@ func (w *WssWorker) pumpRequestBody(ctx context.Context, out *io.PipeWriter) {
 				w.log.Error().
 					AnErr("err", err).
 					Msg("failed to send request body")
+				// closing the pipe is a no-op if the reader closed it first.
+				_ = out.CloseWithError(w.readError("RequestBodyError", "request body", n, err))
 				return
 			}
 
 			w.log.Debug().Int64("bytesSent", n).Msg("sending request body")
 		case websocket.MessageText:
-			n, err := message.Read(buf)
-
-			w.log.Debug().
-				Bytes("recv", buf[0:n]).
-				Msg("expecting a marker")
-
-			if n == 2 {
-				if bytes.Compare([]byte(MarkerReqBodyEnded), buf[0:2]) == 0 {
-					err := out.Close()
-					if err != nil {
-						w.log.Error().
-							Bytes("marker", buf[0:2]).
-							Msg("unexpected marker")
-						return
-					}
-
-					w.log.Debug().
-						Msg("request ended")
-					return
-				}
+			markerBuf := buffers.Get()
+			_, err := io.CopyBuffer(markerBuf, message, buf)
+			ended := err == nil && bytes.Equal(markerBuf.Bytes(), []byte(MarkerReqBodyEnded))
+			size := markerBuf.Len()
+			var trailer http.Header
+			var trailerErr error
+			if err == nil && !ended && body != nil && body.received == nil {
+				// the announced trailers come right before the end marker.
+				trailer, trailerErr = parseTrailer(markerBuf.Bytes())
 			}
+			buffers.Release(markerBuf)
 
-			w.log.Error().Bytes("recv", buf[0:n]).Msg("protocol error: not a marker")
+			if ended {
+				_ = out.Close()
+				w.log.Debug().
+					Msg("request ended")
+				return
+			}
 
-			if err != nil || err != io.EOF {
+			if err != nil {
 				w.log.Error().AnErr("err", err).Msg("error reading marker")
+				_ = out.CloseWithError(w.readError("RequestBodyError", "request body", int64(size), err))
+				return
+			}
+
+			if trailer != nil {
+				w.log.Debug().Int("trailers", len(trailer)).Msg("request trailers received")
+				body.received = trailer
+				continue
+			}
+
+			if trailerErr != nil {
+				w.log.Error().AnErr("err", trailerErr).Msg("protocol error: malformed trailers")
+				_ = out.CloseWithError(fmt.Errorf("CrankerProtoError: malformed request trailers: %w", trailerErr))
 				return
 			}
+
+			// the body ends with a bare marker, anything else is an error, unannounced trailers included.
+			w.log.Error().Int("bytesRecv", size).Msg("protocol error: not a marker")
+			_ = out.CloseWithError(errors.New("CrankerProtoError: text message in request body is not the end marker"))
+			return
 		}
 	}
 }
 
-func (w *WssWorker) Serve(sigTerm context.Context, sem *semaphore.Weighted, client *http.Client) (retErr error) {
+// Serve handles one request / response on the connection. Idle connections are closed when sigDrain is done,
+// in-flight requests are cancelled when sigKill is done. p is released as soon as a request arrives.
+// transport sends the request to the service, unless it's served by Handler or Accept.
+func (w *WssWorker) Serve(sigDrain, sigKill context.Context, p *permit, transport http.RoundTripper) (retErr error) {
 	buf := raw8kBuffers.Get().([]byte)
 	defer raw8kBuffers.Put(buf)
 
+	w.permit = p
+	defer p.release()
+
+	sigIdle, retire := context.WithCancel(sigDrain)
+	defer retire()
+	w.retire = retire
+
+	// an in-flight request is cancelled once the lifetime of the connection expires.
+	// it's only released after the connection is closed, cancelling its reader earlier would cut the close short.
+	sigKill, expire := context.WithCancel(sigKill)
+	defer expire()
+
+	defer func() {
+		// closing the connection stops the request body pump.
+		w.stopPing()
+		w.bg.Wait()
+	}()
+
 	defer func(conn *websocket.Conn) {
 		if retErr == nil {
 			w.log.Info().Msg("wss connection closed after response finished")
@@ -271,7 +455,8 @@ func (w *WssWorker) Serve(sigTerm context.Context, sem *semaphore.Weighted, clie
 		} else {
 			if errors.Is(retErr, context.Canceled) {
 				w.log.Info().Msg("wss connection cancelled, closed gracefully")
-				// the connection is cancelled, so already closed
+				// an idle connection is already closed by the cancelled reader, an in-flight one isn't.
+				_ = conn.Close(websocket.StatusGoingAway, "connector shutting down")
 			} else {
 				err := conn.Close(websocket.StatusAbnormalClosure, "shouldn't end up here, fix it")
 				if err != nil {
@@ -283,8 +468,28 @@ func (w *WssWorker) Serve(sigTerm context.Context, sem *semaphore.Weighted, clie
 
 	w.log.Info().Msg("waiting for request")
 
-	req, err := w.nextRequest(sigTerm, buf)
-	sem.Release(1)
+	waiting, stopWaiting := context.WithCancel(sigIdle)
+	if (w.MaxIdle > 0 || w.MaxLifetime > 0) && w.Recycle != nil {
+		w.bg.Add(1)
+		go func() {
+			defer w.bg.Done()
+			w.recycleWhenExpired(waiting)
+		}()
+	}
+
+	req, err := w.nextRequest(sigIdle, sigKill, buf)
+	stopWaiting()
+	p.release()
+	if left := time.Until(w.connected.Add(w.MaxLifetime)); w.MaxLifetime > 0 && left > 0 {
+		expired := time.AfterFunc(left, func() {
+			w.log.Warn().Msg("connection lifetime expired, cancelling the in-flight request")
+			expire()
+		})
+		defer expired.Stop()
+	}
+	if errors.Is(err, ErrHeadTooLarge) {
+		return w.sendError(sigKill, nil, err, buf)
+	}
 	if err != nil {
 		if errors.Is(err, context.Canceled) {
 			w.log.Info().Msg("cancelled waiting for request")
@@ -295,38 +500,64 @@ func (w *WssWorker) Serve(sigTerm context.Context, sem *semaphore.Weighted, clie
 		}
 	}
 
-	sigKill := util.WithGrace(sigTerm, w.ShutdownTimeout)
-	req = req.WithContext(sigKill)
+	prefix := ""
+	if strings.HasPrefix(req.RequestURI, w.servicePrefix) {
+		prefix = w.servicePrefix
+	}
+	removeHopHeaders(req.Header, true)
+	w.Forwarder.forward(req, prefix, w.proto)
+	if w.RewritePaths {
+		w.rewriter = newPathRewriter(prefix, req.Host)
+	}
 
-	resp, err := w.sendRequest(client, req)
-	if err != nil {
-		if errors.Is(err, context.DeadlineExceeded) {
+	if w.BodyLimit != nil {
+		if max := w.BodyLimit(req); max > 0 {
+			err := limitBody(req, max)
+			if err != nil {
+				if req.Body != nil {
+					// stops the request body pump, the rest of the body is discarded with the connection.
+					_ = req.Body.Close()
+				}
+				return w.sendError(sigKill, req, err, buf)
+			}
+		}
+	}
+
+	if w.Handler != nil {
+		return w.serveHandler(sigKill, req)
+	}
+
+	if w.Accept != nil {
+		return w.serveConn(sigKill, req, buf)
+	}
+
+	w.log.Info().
+		Str("url", req.URL.String()).
+		Msg("proxying request")
+
+	resp, err := w.roundTrip(transport, req)
+	if err == nil {
+		removeHopHeaders(resp.Header, false)
+	} else {
+		if req.Body != nil {
+			// stops the request body pump, the chain may have failed without closing the body.
+			_ = req.Body.Close()
+		}
+
+		if sigKill.Err() != nil {
+			// the connection is torn down, there is no one to respond to.
 			w.log.Warn().
-				Msg("in-flight request timeout during grace period")
+				Msg("in-flight request cancelled after grace period")
 
-			resp = &http.Response{
-				Status:     "504 Gateway Timeout",
-				StatusCode: 504,
-				Body:       nil,
-			}
-		} else {
-			errId := uuid.NewString()
-			w.log.Error().
-				AnErr("reqErr", err).
-				Str("errorId", errId).
-				Msg("error sending request")
-
-			resp = &http.Response{
-				Status:     "500 Server Error",
-				StatusCode: 500,
-				Body:       ioutil.NopCloser(bytes.NewBufferString(fmt.Sprintf("errorId=%s\n", errId))),
-			}
+			return sigKill.Err()
 		}
+
+		return w.sendError(sigKill, req, err, buf)
 	}
 
 	err = w.sendResponse(sigKill, resp, buf)
 	if err != nil {
-		if errors.Is(err, context.DeadlineExceeded) {
+		if sigKill.Err() != nil {
 			w.log.Warn().
 				Msg("in-flight response timeout during grace period")
 
@@ -340,29 +571,114 @@ func (w *WssWorker) Serve(sigTerm context.Context, sem *semaphore.Weighted, clie
 	return nil
 }
 
-func (w *WssWorker) sendRequest(client *http.Client, req *http.Request) (*http.Response, error) {
-	serviceURL, err := url.Parse(w.ServiceURL)
-	if err != nil {
-		return nil, fmt.Errorf("InvalidServiceURLError: %w", err)
-	}
+// serveHandler calls Handler with a ResponseWriter which streams the response to the router.
+// A panicking Handler aborts the response, the same as with an http.Server.
+func (w *WssWorker) serveHandler(sigKill context.Context, req *http.Request) (retErr error) {
+	rw := newWssResponseWriter(sigKill, w.conn, w.log)
+	rw.rewriter = w.rewriter
+	rw.routerTrailers = w.trailers
 
-	req.URL = serviceURL.ResolveReference(req.URL)
-	req.RequestURI = ""
+	defer func() {
+		if p := recover(); p != nil {
+			if p != http.ErrAbortHandler {
+				w.log.Error().
+					Interface("panic", p).
+					Bytes("stack", debug.Stack()).
+					Msg("handler panicked")
+			}
+
+			retErr = fmt.Errorf("HandlerPanic: %v", p)
+		}
+	}()
+
+	req.RequestURI = req.URL.RequestURI()
 
 	w.log.Info().
 		Str("url", req.URL.String()).
-		Msg("proxying request")
+		Msg("serving request in-process")
+
+	w.Handler.ServeHTTP(rw, req)
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+
+	return rw.finish()
+}
+
+// sendError answers a request which couldn't be proxied, with ErrorPages.Render if any.
+// req is nil when the request is rejected before it's read, Render isn't called then.
+func (w *WssWorker) sendError(sigKill context.Context, req *http.Request, err error, buf []byte) (retErr error) {
+	shuttingDown := w.sigShutdown != nil && w.sigShutdown.Err() != nil
+	proxyErr := newProxyError(err, uuid.NewString(), shuttingDown)
+
+	w.log.Error().
+		AnErr("reqErr", err).
+		Int("status", proxyErr.StatusCode).
+		Str("errorId", proxyErr.ErrorID).
+		Msg("error sending request")
+
+	if w.ErrorPages.Render != nil && req != nil {
+		rw := newWssResponseWriter(sigKill, w.conn, w.log)
+		defer func() {
+			if p := recover(); p != nil {
+				w.log.Error().
+					Interface("panic", p).
+					Bytes("stack", debug.Stack()).
+					Msg("error page renderer panicked")
+
+				retErr = fmt.Errorf("RenderPanic: %v", p)
+			}
+		}()
 
-	return client.Do(req)
+		proxyErr.setHeaders(rw.Header())
+		w.ErrorPages.Render(rw, req, proxyErr)
+		return rw.finish()
+	}
+
+	resp, err := proxyErr.response(w.ErrorPages)
+	if err != nil {
+		w.log.Err(err).Msg("error rendering the error page template")
+	}
+
+	return w.sendResponse(sigKill, resp, buf)
+}
+
+// Close closes a connection which is dialed but not served.
+func (w *WssWorker) Close() {
+	w.stopPing()
+	err := w.conn.Close(websocket.StatusNormalClosure, "not needed")
+	if err != nil {
+		w.log.Err(err).Msg("error closing wss connection")
+	}
+	w.bg.Wait()
 }
 
 func (w *WssWorker) sendResponse(sigKill context.Context, resp *http.Response, buf []byte) error {
 	defer resp.Body.Close()
 
+	w.rewriter.rewrite(resp.Header)
+
+	gzipped := w.Compression.compresses(resp)
+	if gzipped {
+		encode(resp)
+	}
+
+	// the trailers are announced to a router taking them, the others drop them.
+	resp.Header.Del("Trailer")
+	if w.trailers && len(resp.Trailer) > 0 {
+		resp.Header.Set("Trailer", trailerNames(resp.Trailer))
+	}
+
 	var headerBuf *bytes.Buffer = buffers.Get()
 	defer buffers.Release(headerBuf)
 
-	_, err := fmt.Fprintf(headerBuf, "%s %s\r\n", resp.Proto, resp.Status)
+	// the head is an HTTP/1.1 one whatever the protocol of the service, e.g. HTTP/2.
+	proto := resp.Proto
+	if resp.ProtoMajor > 1 {
+		proto = "HTTP/1.1"
+	}
+
+	_, err := fmt.Fprintf(headerBuf, "%s %s\r\n", proto, resp.Status)
 	if err != nil {
 		return err
 	}
@@ -380,23 +696,25 @@ func (w *WssWorker) sendResponse(sigKill context.Context, resp *http.Response, b
 		return err
 	}
 
+	var out io.Writer = &frameWriter{ctx: sigKill, conn: w.conn}
+	if gzipped {
+		gz := newGzipFrameWriter(out, w.Compression.Level)
+		defer gz.release()
+		out = gz
+	}
+
 	for {
 		nread, err := resp.Body.Read(buf)
 		if nread > 0 {
 			w.log.Debug().Int("bytesRead", nread).Msg("response read")
 
-			wssWriter, _ := w.conn.Writer(sigKill, websocket.MessageBinary)
-			nsent, err := io.Copy(wssWriter, bytes.NewReader(buf[0:nread]))
+			_, err := out.Write(buf[0:nread])
 			if err != nil {
 				w.log.Error().AnErr("err", err).Msg("Error sending response")
-			}
-
-			err = wssWriter.Close()
-			if err != nil {
 				return err
 			}
 
-			w.log.Debug().Int64("bytesSent", nsent).Msg("response sent")
+			w.log.Debug().Int("bytesSent", nread).Msg("response sent")
 		}
 
 		if err != nil && err != io.EOF {
@@ -409,5 +727,30 @@ func (w *WssWorker) sendResponse(sigKill context.Context, resp *http.Response, b
 		}
 	}
 
-	return nil
+	if gz, ok := out.(*gzipFrameWriter); ok {
+		// the gzip footer ends the body.
+		err := gz.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.sendTrailers(sigKill, resp.Trailer)
+}
+
+// sendTrailers sends the trailers of a response once its body is sent, to a router taking them.
+// They are dropped otherwise. Their values are left out of the logs, they may be checksums or tokens.
+func (w *WssWorker) sendTrailers(sigKill context.Context, trailer http.Header) error {
+	if len(trailer) == 0 {
+		return nil
+	}
+
+	if !w.trailers {
+		w.log.Debug().Int("trailers", len(trailer)).Msg("dropping trailers")
+		return nil
+	}
+
+	w.log.Debug().Int("trailers", len(trailer)).Msg("sending response trailers")
+
+	return writeTrailer(sigKill, w.conn, trailer)
 }
@@ -0,0 +1,466 @@
+// Package crankertest provides an in-process cranker router for tests.
+// It speaks the same protocol as a real router, with a plain http front-end and a ws register endpoint.
+// The front-end speaks HTTP/2 without TLS to the clients asking for it, e.g. gRPC clients.
+package crankertest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"nhooyr.io/websocket"
+)
+
+const markerReqBodyPending = "_1"
+const markerReqHasNoBody = "_2"
+const markerReqBodyEnded = "_3"
+const trailersSubprotocol = "cranker-trailers"
+
+// Router routes requests from its front-end to idle sockets registered by connectors.
+type Router struct {
+	// URL is the front-end url, requests to URL/<route>/... are routed to connectors registered with <route>.
+	URL string
+	// IdleWait is how long a request waits for an idle socket before a 503 is returned.
+	IdleWait time.Duration
+	// Trailers makes the router pick the trailers subprotocol for the connectors registering from now on:
+	// the trailers of a request are sent before its end marker, and the ones of a response follow its body.
+	Trailers bool
+
+	front        *httptest.Server
+	registration *httptest.Server
+	m            sync.Mutex
+	changed      chan struct{}
+	idle         map[string][]*socket
+	lowWater     map[string]int
+	registered   map[string]int
+	deregistered []string
+}
+
+type message struct {
+	typ  websocket.MessageType
+	data []byte
+}
+
+type socket struct {
+	conn       *websocket.Conn
+	route      string
+	instanceID string
+	msgs       chan message
+	closeErr   error
+	// trailers tells if the trailers subprotocol was picked for the socket.
+	trailers bool
+}
+
+// NewRouter starts a router. Call Close when done.
+func NewRouter() *Router {
+	r := &Router{
+		IdleWait:   5 * time.Second,
+		changed:    make(chan struct{}),
+		idle:       map[string][]*socket{},
+		lowWater:   map[string]int{},
+		registered: map[string]int{},
+	}
+
+	r.front = httptest.NewServer(h2c.NewHandler(http.HandlerFunc(r.serveFront), &http2.Server{}))
+	r.registration = httptest.NewServer(http.HandlerFunc(r.serveRegistration))
+	r.URL = r.front.URL
+
+	return r
+}
+
+// RegisterURL is the url to give to the connector's Discoverer.
+func (r *Router) RegisterURL() string {
+	return "ws" + strings.TrimPrefix(r.registration.URL, "http") + "/register"
+}
+
+// Close closes all sockets and stops the router.
+func (r *Router) Close() {
+	r.m.Lock()
+	for _, sockets := range r.idle {
+		for _, s := range sockets {
+			_ = s.conn.Close(websocket.StatusGoingAway, "router closing")
+		}
+	}
+	r.idle = map[string][]*socket{}
+	r.m.Unlock()
+
+	r.front.CloseClientConnections()
+	r.registration.CloseClientConnections()
+	r.front.Close()
+	r.registration.Close()
+}
+
+// Idle returns the number of idle sockets registered for route.
+func (r *Router) Idle(route string) int {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return len(r.idle[route])
+}
+
+// WaitIdle blocks until the number of idle sockets for route satisfies cond, or the timeout is reached.
+func (r *Router) WaitIdle(route string, timeout time.Duration, cond func(n int) bool) bool {
+	deadline := time.After(timeout)
+	for {
+		r.m.Lock()
+		n := len(r.idle[route])
+		changed := r.changed
+		r.m.Unlock()
+
+		if cond(n) {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// ResetLowWater starts tracking the lowest number of idle sockets for route, see LowWater.
+func (r *Router) ResetLowWater(route string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.lowWater[route] = len(r.idle[route])
+}
+
+// LowWater returns the lowest number of idle sockets for route since ResetLowWater.
+func (r *Router) LowWater(route string) int {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.lowWater[route]
+}
+
+// Registered returns the number of sockets ever registered for route.
+func (r *Router) Registered(route string) int {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return r.registered[route]
+}
+
+// Deregistered returns the connector instance ids which called the deregister endpoint.
+func (r *Router) Deregistered() []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	return append([]string{}, r.deregistered...)
+}
+
+// notify must be called with r.m held.
+func (r *Router) notify() {
+	for route, low := range r.lowWater {
+		if n := len(r.idle[route]); n < low {
+			r.lowWater[route] = n
+		}
+	}
+
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+func (r *Router) serveRegistration(rw http.ResponseWriter, req *http.Request) {
+	switch strings.TrimSuffix(req.URL.Path, "/") {
+	case "/register":
+		r.register(rw, req)
+	case "/deregister":
+		r.deregister(rw, req)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func (r *Router) register(rw http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("CrankerProtocol") != "1.0" {
+		http.Error(rw, "unsupported CrankerProtocol", http.StatusBadRequest)
+		return
+	}
+
+	opts := &websocket.AcceptOptions{}
+	r.m.Lock()
+	if r.Trailers {
+		opts.Subprotocols = []string{trailersSubprotocol}
+	}
+	r.m.Unlock()
+
+	conn, err := websocket.Accept(rw, req, opts)
+	if err != nil {
+		return
+	}
+
+	conn.SetReadLimit(1 << 30)
+
+	s := &socket{
+		conn:       conn,
+		route:      req.Header.Get("Route"),
+		instanceID: req.URL.Query().Get("connectorInstanceID"),
+		msgs:       make(chan message, 16),
+		trailers:   conn.Subprotocol() == trailersSubprotocol,
+	}
+
+	r.m.Lock()
+	r.idle[s.route] = append(r.idle[s.route], s)
+	r.registered[s.route]++
+	r.notify()
+	r.m.Unlock()
+
+	// keep reading so that ping / close frames are handled and a closed idle socket is noticed.
+	for {
+		typ, data, err := conn.Read(context.Background())
+		if err != nil {
+			s.closeErr = err
+			r.remove(s)
+			close(s.msgs)
+			return
+		}
+
+		s.msgs <- message{typ: typ, data: data}
+	}
+}
+
+func (r *Router) deregister(rw http.ResponseWriter, req *http.Request) {
+	instanceID := req.URL.Query().Get("connectorInstanceID")
+	conn, err := websocket.Accept(rw, req, nil)
+	if err != nil {
+		return
+	}
+
+	var closing []*socket
+	r.m.Lock()
+	r.deregistered = append(r.deregistered, instanceID)
+	for route, sockets := range r.idle {
+		var remaining []*socket
+		for _, s := range sockets {
+			if s.instanceID == instanceID {
+				closing = append(closing, s)
+			} else {
+				remaining = append(remaining, s)
+			}
+		}
+		r.idle[route] = remaining
+	}
+	r.notify()
+	r.m.Unlock()
+
+	for _, s := range closing {
+		go s.conn.Close(websocket.StatusGoingAway, "deregistered")
+	}
+
+	_, _, _ = conn.Read(context.Background())
+}
+
+func (r *Router) remove(s *socket) bool {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	sockets := r.idle[s.route]
+	for i, idle := range sockets {
+		if idle == s {
+			r.idle[s.route] = append(sockets[:i:i], sockets[i+1:]...)
+			r.notify()
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Router) take(ctx context.Context, route string) (*socket, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.IdleWait)
+	defer cancel()
+
+	for {
+		r.m.Lock()
+		sockets := r.idle[route]
+		if len(sockets) > 0 {
+			s := sockets[0]
+			r.idle[route] = sockets[1:]
+			r.notify()
+			r.m.Unlock()
+			return s, nil
+		}
+		changed := r.changed
+		r.m.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (r *Router) serveFront(rw http.ResponseWriter, req *http.Request) {
+	route := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)[0]
+
+	s, err := r.take(req.Context(), route)
+	if err != nil {
+		http.Error(rw, "no connector available for "+route, http.StatusServiceUnavailable)
+		return
+	}
+	defer s.conn.Close(websocket.StatusNormalClosure, "done")
+
+	hasBody := req.ContentLength != 0 && req.Body != nil && req.Body != http.NoBody
+	trailers := hasBody && s.trailers && len(req.Trailer) > 0
+
+	head := &bytes.Buffer{}
+	fmt.Fprintf(head, "%s %s HTTP/1.1\r\n", req.Method, req.RequestURI)
+	fmt.Fprintf(head, "Host: %s\r\n", req.Host)
+	_ = req.Header.Write(head)
+	if trailers {
+		names := make([]string, 0, len(req.Trailer))
+		for k := range req.Trailer {
+			names = append(names, k)
+		}
+		fmt.Fprintf(head, "Trailer: %s\r\n", strings.Join(names, ", "))
+	}
+	head.WriteString("\r\n")
+	if hasBody {
+		head.WriteString(markerReqBodyPending)
+	} else {
+		head.WriteString(markerReqHasNoBody)
+	}
+
+	ctx := req.Context()
+	err = s.conn.Write(ctx, websocket.MessageText, head.Bytes())
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if hasBody {
+		go func() {
+			buf := make([]byte, 8*1024)
+			for {
+				n, err := req.Body.Read(buf)
+				if n > 0 {
+					if s.conn.Write(ctx, websocket.MessageBinary, buf[:n]) != nil {
+						return
+					}
+				}
+				if err == io.EOF {
+					// the values of the trailers are known once the body is read.
+					if trailers {
+						trailer := &bytes.Buffer{}
+						_ = req.Trailer.Write(trailer)
+						if s.conn.Write(ctx, websocket.MessageText, trailer.Bytes()) != nil {
+							return
+						}
+					}
+					_ = s.conn.Write(ctx, websocket.MessageText, []byte(markerReqBodyEnded))
+					return
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	m, ok := <-s.msgs
+	if !ok {
+		http.Error(rw, fmt.Sprintf("connector closed socket: %v", s.closeErr), http.StatusBadGateway)
+		return
+	}
+
+	status, header, err := parseResponseHead(m)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	for k, vs := range header {
+		for _, v := range vs {
+			rw.Header().Add(k, v)
+		}
+	}
+	rw.WriteHeader(status)
+
+	trailed := false
+	for m := range s.msgs {
+		if trailed || m.typ != websocket.MessageBinary && !s.trailers {
+			// nothing follows the trailers, which only follow the body with the trailers subprotocol.
+			panic(http.ErrAbortHandler)
+		}
+
+		if m.typ != websocket.MessageBinary {
+			trailer, err := parseHeader(m.data)
+			if err != nil {
+				panic(http.ErrAbortHandler)
+			}
+
+			for k, vs := range trailer {
+				for _, v := range vs {
+					rw.Header().Add(http.TrailerPrefix+k, v)
+				}
+			}
+			trailed = true
+			continue
+		}
+
+		_, _ = rw.Write(m.data)
+		if f, ok := rw.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	if websocket.CloseStatus(s.closeErr) != websocket.StatusNormalClosure {
+		// the response is incomplete, let the client see it.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func parseResponseHead(m message) (int, http.Header, error) {
+	if m.typ != websocket.MessageText {
+		return 0, nil, errors.New("response not started with text message")
+	}
+
+	tp := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(m.data), strings.NewReader("\r\n"))))
+	line, err := tp.ReadLine()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 {
+		return 0, nil, fmt.Errorf("malformed status line %q", line)
+	}
+
+	status, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, nil, fmt.Errorf("malformed status line %q", line)
+	}
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return 0, nil, err
+	}
+
+	return status, http.Header(header), nil
+}
+
+func parseHeader(data []byte) (http.Header, error) {
+	tp := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(data), strings.NewReader("\r\n"))))
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return http.Header(header), nil
+}
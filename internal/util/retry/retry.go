@@ -1,6 +1,7 @@
 package retry
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
@@ -43,6 +44,11 @@ var EndOfRetry = errors.New("end of retry")
 
 // Retry until Op returns nil / EndOfRetry error, or BackoffStrategy returns any non-nil error
 func Retry(doOp Op, strategy BackoffStrategy) (interface{}, error) {
+	return RetryContext(context.Background(), doOp, strategy)
+}
+
+// RetryContext is Retry which also stops with EndOfRetry when ctx is done while waiting for the next retry.
+func RetryContext(ctx context.Context, doOp Op, strategy BackoffStrategy) (interface{}, error) {
 	for {
 		v, opErr := doOp()
 		if opErr != nil {
@@ -58,8 +64,14 @@ func Retry(doOp Op, strategy BackoffStrategy) (interface{}, error) {
 			}
 
 			// retry after backoff
-			time.Sleep(duration)
-			continue
+			timer := time.NewTimer(duration)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, fmt.Errorf("%s: %w", ctx.Err(), EndOfRetry)
+			case <-timer.C:
+				continue
+			}
 		}
 
 		// operation success
@@ -1,6 +1,7 @@
 package retry
 
 import (
+	"context"
 	"errors"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -35,3 +36,22 @@ func TestExpoBackoff_StopAfterSuccess(t *testing.T) {
 	expect.Nil(err)
 	expect.Equal(1, result)
 }
+
+func TestRetryContext_StopWhileBackingOff(t *testing.T) {
+	expect := assert.New(t)
+	backoff := &ExpBackoff{MinInterval: time.Minute}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	count := 0
+	start := time.Now()
+	result, err := RetryContext(ctx, func() (interface{}, error) {
+		count++
+		return count, errors.New("any error")
+	}, backoff)
+
+	expect.True(errors.Is(err, EndOfRetry))
+	expect.Nil(result)
+	expect.Equal(1, count)
+	expect.True(time.Since(start) < time.Second)
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/JackKCWong/go-cranker-connector/connector"
 	"github.com/rs/zerolog"
@@ -10,7 +12,6 @@ import (
 	"os"
 	"os/signal"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 )
@@ -34,16 +35,13 @@ func main() {
 		RediscoveryInterval: 5 * time.Second,
 	}
 
-	c := make(chan os.Signal)
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	var wg sync.WaitGroup
-	wg.Add(1)
 	go func() {
-		defer wg.Done()
 		<-c
 		log.Info().Msg("shutting down...")
-		conn.Shutdown()
-		log.Info().Msg("shutdown finished")
+		cancel()
 	}()
 
 	crankers := strings.Split(crankerWss, ",")
@@ -53,18 +51,20 @@ func main() {
 	}
 
 	idx := 0
-	err := conn.Connect(func() []string {
+	err := conn.Run(ctx, func() []string {
 		// for demo purpose, it swings between crankers.
 		idx++
 		return []string{urls[idx%len(urls)]}
 	}, 2)
 
-	if err != nil {
-		fmt.Printf("Error connecting cranker %s, err: %q", crankerWss, err)
-		return
+	if errors.Is(err, context.DeadlineExceeded) {
+		// in-flight requests were cancelled at ShutdownTimeout, the shutdown itself went fine.
+		log.Warn().Msg("in-flight requests cancelled after shutdown timeout")
+	} else if err != nil {
+		fmt.Printf("Error running connector to cranker %s, err: %q", crankerWss, err)
+		os.Exit(1)
 	}
 
-	wg.Wait()
-
+	log.Info().Msg("shutdown finished")
 	os.Exit(0)
 }